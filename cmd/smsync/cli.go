@@ -34,25 +34,45 @@ var rootCmd = &cobra.Command{
 			return err
 		}
 
-		// set up logging
-		var level log.Level
-		if cli.log {
-			level = log.DebugLevel
-		} else {
-			level = log.ErrorLevel
-		}
-
 		// call synchronization (which contains the main logic of smsync)
-		return synchronize(level, cli.verbose)
+		return synchronize(logLevel(), cli.verbose)
+	},
+}
+
+// prune command
+var pruneCmd = &cobra.Command{
+	Use:                   "prune [options]",
+	Short:                 "Delete target files that don't have a valid source file",
+	Long:                  "Walks the entire target directory tree, maps every target file back to its expected source file using the current rules and exclusions, lists all target files without a valid source file and deletes them after confirmation",
+	DisableFlagsInUseLine: true,
+	Args:                  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return prune(logLevel())
+	},
+}
+
+// verify command
+var verifyCmd = &cobra.Command{
+	Use:                   "verify [options]",
+	Short:                 "Compare source and target directory trees",
+	Long:                  "Compares the source with the target directory tree and reports missing, outdated, empty and orphaned target files as well as target files with a wrong suffix. Nothing is changed. If discrepancies are found, the exit code is non-zero",
+	DisableFlagsInUseLine: true,
+	SilenceUsage:          true,
+	Args:                  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return verify(cli.log)
 	},
 }
 
 // variables to store command line flags
 var cli struct {
-	log       bool // switch on logging
-	init      bool // initialize
-	noConfirm bool // don't ask for confirmation
-	verbose   bool // print detailed progress
+	target    string // target directory
+	config    string // path of configuration file
+	dryRun    bool   // only print what would be done
+	log       bool   // switch on logging
+	init      bool   // initialize
+	noConfirm bool   // don't ask for confirmation
+	verbose   bool   // print detailed progress
 }
 
 func init() {
@@ -60,14 +80,32 @@ func init() {
 	rootCmd.SetHelpTemplate(helpTemplate)
 
 	// define flag ...
+	// - dry run
+	rootCmd.Flags().BoolVarP(&cli.dryRun, "dry-run", "n", false, "print the planned actions without changing the target directory")
 	// - initialize
 	rootCmd.Flags().BoolVarP(&cli.init, "init", "i", false, "delete content of target directory and do initial sync ignoring the change times on source side")
+	// - target directory
+	rootCmd.PersistentFlags().StringVarP(&cli.target, "target", "t", "", "target directory (default: current working directory)")
+	// - configuration file
+	rootCmd.PersistentFlags().StringVarP(&cli.config, "config", "c", "", "configuration file (default: smsync.yaml in target directory)")
 	// - logging
-	rootCmd.Flags().BoolVarP(&cli.log, "log", "l", false, "switch on logging")
+	rootCmd.PersistentFlags().BoolVarP(&cli.log, "log", "l", false, "switch on logging")
 	// - print detailed progress
 	rootCmd.Flags().BoolVarP(&cli.verbose, "verbose", "v", false, "print detailed progress")
 	// - no confirmation
-	rootCmd.Flags().BoolVarP(&cli.noConfirm, "yes", "y", false, "don't ask for confirmation")
+	rootCmd.PersistentFlags().BoolVarP(&cli.noConfirm, "yes", "y", false, "don't ask for confirmation")
+
+	// add sub commands
+	rootCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// logLevel determines the log level from the command line flags
+func logLevel() log.Level {
+	if cli.log {
+		return log.DebugLevel
+	}
+	return log.ErrorLevel
 }
 
 // Execute executes the root command
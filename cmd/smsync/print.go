@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"time"
 
@@ -16,10 +17,7 @@ import (
 // information
 func printCfgSummary(cfg *smsync.Config) {
 	const fmGen = "   %-12s: %s\n" // format string for general config values
-	var (
-		fmRl    string // format string for conversion rules
-		hasStar bool
-	)
+	var fmRl string                // format string for conversion rules
 
 	// assemble format string for conversion rules
 	{
@@ -27,15 +25,15 @@ func printCfgSummary(cfg *smsync.Config) {
 			lenTrg int
 			lenSrc int
 		)
-		for srcSuffix, cv := range cfg.Cvs {
-			if len(srcSuffix) > lenSrc {
-				lenSrc = len(srcSuffix)
+		for _, cv := range cfg.Cvs {
+			if len(cv.SrcSuffix) > lenSrc {
+				lenSrc = len(cv.SrcSuffix)
 			}
 			if len(cv.TrgSuffix) > lenTrg {
 				lenTrg = len(cv.TrgSuffix)
 			}
 		}
-		fmRl = "       %-" + strconv.Itoa(lenSrc) + "s -> %-" + strconv.Itoa(lenTrg) + "s = %s\n"
+		fmRl = "       %-" + strconv.Itoa(lenSrc) + "s -> %-" + strconv.Itoa(lenTrg) + "s = %s%s\n"
 	}
 
 	// configuration headline
@@ -44,9 +42,17 @@ func printCfgSummary(cfg *smsync.Config) {
 	// source directory
 	fmt.Printf(fmGen, "Source", cfg.SrcDir.Path()) // nolint
 
-	// directories to exclude
+	// sub trees to include
+	if len(cfg.Includes) > 0 {
+		fmt.Printf(fmGen, "Include", "") // nolint
+		for _, s := range cfg.Includes {
+			fmt.Printf("       %s\n", s)
+		}
+	}
+
+	// directories and files to exclude
 	if len(cfg.Excludes) > 0 {
-		fmt.Printf(fmGen, "Exclude (expanded)", "") // nolint
+		fmt.Printf(fmGen, "Exclude", "") // nolint
 		for _, s := range cfg.Excludes {
 			fmt.Printf("       %s\n", s)
 		}
@@ -55,6 +61,53 @@ func printCfgSummary(cfg *smsync.Config) {
 	// target directory
 	fmt.Printf(fmGen, "Destination", cfg.TrgDir.Path()) // nolint
 
+	// file system of the target (only displayed if names are sanitized)
+	if cfg.TrgFS != smsync.TrgFSPosix {
+		fmt.Printf(fmGen, "File System", cfg.TrgFS) // nolint
+	}
+
+	// template for target paths
+	if cfg.TrgPath != "" {
+		fmt.Printf(fmGen, "Target Path", cfg.TrgPath) // nolint
+	}
+
+	// copy mode (only displayed if it's not the default)
+	if cfg.CopyMode != smsync.CopyModeCopy {
+		fmt.Printf(fmGen, "Copy Mode", cfg.CopyMode) // nolint
+	}
+
+	// attributes of target files and directories (only displayed if they
+	// are configured)
+	if cfg.TrgMTime != smsync.TrgMTimeNow {
+		fmt.Printf(fmGen, "Target MTime", cfg.TrgMTime) // nolint
+	}
+	if cfg.FileMode != 0 {
+		fmt.Printf(fmGen, "File Mode", fmt.Sprintf("%04o", cfg.FileMode)) // nolint
+	}
+	if cfg.DirMode != 0 {
+		fmt.Printf(fmGen, "Dir Mode", fmt.Sprintf("%04o", cfg.DirMode)) // nolint
+	}
+
+	// reserve of free space on the target device
+	if cfg.MinFree > 0 {
+		fmt.Printf(fmGen, "Min Free", fmt.Sprintf("%d MB", cfg.MinFree/(1024*1024))) // nolint
+	}
+
+	// size budget and the estimated target size with the chosen conversions
+	if fit := cfg.Fit; fit != nil {
+		fmt.Printf(fmGen, "Budget", fmt.Sprintf("%d MB", fit.Budget/(1024*1024))) // nolint
+		est := fmt.Sprintf("%d MB with ladder step %d of %d", fit.Size/(1024*1024), fit.Step, fit.Steps)
+		if !fit.Fits {
+			est += " (EXCEEDS BUDGET)"
+		}
+		fmt.Printf(fmGen, "Est. Size", est) // nolint
+	}
+
+	// processing order (only displayed if it's not the default)
+	if cfg.Order != smsync.OrderPath {
+		fmt.Printf(fmGen, "Order", cfg.Order) // nolint
+	}
+
 	// last sync time
 	if cfg.LastSync.IsZero() {
 		fmt.Printf(fmGen, "Last Sync", "Not set, initial sync") // nolint
@@ -72,26 +125,126 @@ func printCfgSummary(cfg *smsync.Config) {
 
 	// conversions
 	fmt.Printf(fmGen, "Conversions", "") // nolint
-	for srcSuffix, cv := range cfg.Cvs {
-		if srcSuffix == "*" {
-			hasStar = true
-			continue
+	for _, cv := range cfg.Cvs {
+		var path string
+		if cv.Path != "" {
+			path = " (path: " + cv.Path + ")"
+		}
+		if cond := cv.CondDesc(); cond != "" {
+			path += " (" + cond + ")"
+		}
+		if ladder := cv.LadderDesc(); ladder != "" {
+			path += " (" + ladder + ")"
+		}
+		fmt.Printf(fmRl, cv.SrcSuffix, cv.TrgSuffix, cfg.CvStr(cv), path) // nolint
+	}
+}
+
+// printCollisions displays the source files that are mapped to the same
+// target file and how these collisions are resolved
+func printCollisions(cfg *smsync.Config) {
+	if len(cfg.Collisions) == 0 {
+		return
+	}
+
+	fmt.Printf("\n:: Collisions (policy: %s)\n", cfg.CollPolicy)
+	for _, c := range cfg.Collisions {
+		fmt.Printf("   %s\n", c.TrgFile)
+		for i, src := range c.SrcFiles {
+			switch {
+			case c.TrgFiles[i] == "":
+				fmt.Printf("       <- %s (skipped)\n", src)
+			case c.TrgFiles[i] != c.TrgFile:
+				fmt.Printf("       <- %s (stored as %s)\n", src, c.TrgFiles[i])
+			default:
+				fmt.Printf("       <- %s\n", src)
+			}
+		}
+	}
+}
+
+// printExclDirs displays the target directories that are deleted since their
+// source directories are excluded
+func printExclDirs(cfg *smsync.Config, dirs []string) {
+	fmt.Println("\n:: Target directories of excluded source directories")
+	for _, dir := range dirs {
+		r, err := filepath.Rel(cfg.TrgDir.Path(), dir)
+		if err != nil {
+			log.Error(err)
+			r = dir
+		}
+		fmt.Printf("   %s%c\n", r, filepath.Separator)
+	}
+}
+
+// printPlan displays the actions that a synchronization would execute. It's
+// used if the user called smsync with the option --dry-run / -n
+func printPlan(cfg *smsync.Config, wl *[]*smsync.WorkItem, init bool) {
+	var (
+		cvs  []string // conversions
+		cps  []string // copies
+		mvs  []string // moves
+		lnks []string // symbolic links
+		dels []string // deletions of files
+		dirs []string // deletions of directories
+	)
+
+	// local function to get paths relative to base
+	rel := func(base, path string) string {
+		r, err := filepath.Rel(base, path)
+		if err != nil {
+			log.Error(err)
+			return path
+		}
+		return r
+	}
+
+	for _, item := range *wl {
+		switch item.Kind {
+		case smsync.ItemConvert:
+			src := rel(cfg.SrcDir.Path(), item.SrcFile.Path())
+			trg := rel(cfg.TrgDir.Path(), item.TrgFile)
+			if item.CvStr == "copy" {
+				cps = append(cps, fmt.Sprintf("   COPY      %s -> %s", src, trg))
+			} else {
+				cvs = append(cvs, fmt.Sprintf("   CONVERT   %s -> %s (%s)", src, trg, item.CvStr))
+			}
+		case smsync.ItemMove:
+			mvs = append(mvs, fmt.Sprintf("   MOVE      %s -> %s", rel(cfg.TrgDir.Path(), item.FromFile), rel(cfg.TrgDir.Path(), item.TrgFile)))
+		case smsync.ItemDelete:
+			dels = append(dels, fmt.Sprintf("   DELETE    %s", rel(cfg.TrgDir.Path(), item.TrgFile)))
+		case smsync.ItemLink:
+			lnks = append(lnks, fmt.Sprintf("   LINK      %s -> %s", rel(cfg.TrgDir.Path(), item.TrgFile), item.LinkTo))
+		case smsync.ItemDeleteDir:
+			dirs = append(dirs, fmt.Sprintf("   DELETE    %s%c (excluded)", rel(cfg.TrgDir.Path(), item.TrgFile), filepath.Separator))
 		}
-		fmt.Printf(fmRl, srcSuffix, cv.TrgSuffix, cv.NormCvStr) // nolint
 	}
-	if hasStar {
-		fmt.Printf(fmRl, "*", cfg.Cvs["*"].TrgSuffix, cfg.Cvs["*"].NormCvStr) // nolint
+	for _, dir := range smsync.ObsoleteDirs(cfg, wl) {
+		dirs = append(dirs, fmt.Sprintf("   DELETE    %s%c", rel(cfg.TrgDir.Path(), dir), filepath.Separator))
 	}
+
+	fmt.Println("\n:: Planned actions (dry run, target directory is not changed)")
+	if init {
+		fmt.Println("   DELETE    all content of the target directory (initial sync)")
+	}
+	for _, a := range [][]string{dirs, dels, mvs, cvs, cps, lnks} {
+		sort.Strings(a)
+		for _, line := range a {
+			fmt.Println(line)
+		}
+	}
+	fmt.Printf("\n   %d conversions, %d copies, %d moves, %d links, %d deletions of obsolete files, %d deletions of obsolete directories\n",
+		len(cvs), len(cps), len(mvs), len(lnks), len(dels), len(dirs))
 }
 
 func printFinal(trck *smsync.Tracking, verbose bool) {
 	if trck.TotalNum > trck.Done {
-		fmt.Printf("\n:: STOPPED! %d files or directories left to process\n", trck.TotalNum-trck.Done)
+		fmt.Printf("\n:: STOPPED! %d files left to process\n", trck.TotalNum-trck.Done)
 	} else {
 		fmt.Printf("\n:: Done :)\n")
 	}
 	split := t.SplitDuration(trck.Elapsed)
-	fmt.Printf("   Processed %d files and directories in %s\n",
+	fmt.Printf("   Processed %d files in %s\n",
 		trck.Done,
 		fmt.Sprintf("%dh %02dmin %02ds",
 			split[time.Hour],
@@ -105,6 +258,24 @@ func printFinal(trck *smsync.Tracking, verbose bool) {
 	}
 }
 
+// printSkipped displays the source files that have not been synchronized
+// since the free space on the target device would have fallen below the
+// reserve (relative to the source directory)
+func printSkipped(cfg *smsync.Config, items []*smsync.WorkItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	fmt.Printf("\n:: %d files not synchronized since the free space on the target device would fall below %d MB\n", len(items), cfg.MinFree/(1024*1024))
+	for _, item := range items {
+		rel, err := filepath.Rel(cfg.SrcDir.Path(), item.SrcFile.Path())
+		if err != nil {
+			rel = item.SrcFile.Path()
+		}
+		fmt.Printf("   %s\n", rel)
+	}
+}
+
 // printProgress displays the progress of the file conversion
 func printProgress(trck *smsync.Tracking, first, wantstop bool) {
 	const (
@@ -163,16 +334,41 @@ func printProgress(trck *smsync.Tracking, first, wantstop bool) {
 		stop) //nolint
 }
 
-// printVerbose displays detailed information after each conversion. The name
-// of the converted file is displayed relative to the source directory.This
-// function is used if the user called smsync with the option --verbose / -v
+// printVerbose displays detailed information after each conversion or
+// deletion. The name of the converted file is displayed relative to the
+// source directory, the name of a deleted file relative to the target
+// directory. This function is used if the user called smsync with the option
+// --verbose / -v
 func printVerbose(cfg *smsync.Config, pInfo smsync.ProcInfo) {
-	srcFile, err := filepath.Rel(cfg.SrcDir.Path(), pInfo.SrcFile.Path())
+	var (
+		label = "CONVERTED"
+		base  = cfg.SrcDir.Path()
+		path  string
+	)
+
+	switch pInfo.Kind {
+	case smsync.ItemDelete, smsync.ItemDeleteDir:
+		label = "DELETED  "
+		base = cfg.TrgDir.Path()
+		path = pInfo.TrgPath
+	case smsync.ItemMove:
+		label = "MOVED    "
+		base = cfg.TrgDir.Path()
+		path = pInfo.TrgPath
+	case smsync.ItemLink:
+		label = "LINKED   "
+		base = cfg.TrgDir.Path()
+		path = pInfo.TrgPath
+	default:
+		path = pInfo.SrcFile.Path()
+	}
+
+	rel, err := filepath.Rel(base, path)
 	if err != nil {
 		log.Error(err)
 	} else {
 		fmt.Println("----------")
-		fmt.Printf("CONVERTED: %s\n", srcFile)
+		fmt.Printf("%s: %s\n", label, rel)
 		fmt.Printf("DURATION : %2.2fs\n", pInfo.Dur.Seconds())
 		if pInfo.Err != nil {
 			fmt.Println("STATUS   : ERROR")
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/msg"
+	"gitlab.com/mipimipi/smsync/internal/smsync"
+)
+
+// prune determines the target files that don't have a valid source file
+// (orphans), displays them and deletes them after the user confirmed
+func prune(level log.Level) error {
+	// logger needs to be created before the first log entry is generated!!!
+	if err := smsync.CreateLogger(cli.target, level); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	log.Debug("cli.prune: BEGIN")
+	defer log.Debug("cli.prune: END")
+
+	// print copyright etc. on command line
+	fmt.Println(preamble)
+
+	// read configuration
+	cfg := new(smsync.Config)
+	if err := cfg.Get(cli.target, cli.config, false); err != nil {
+		return err
+	}
+	defer smsync.CleanUp(cfg)
+
+	// start automatic progress string which increments every second
+	stop, confirm := msg.ProgressStr(":: Find orphaned target files (this can take a few minutes)", 1000)
+
+	// get target files without valid source file
+	orphans := smsync.Orphans(cfg)
+
+	// stop progress string and receive stop confirmation. The confirmation is necessary to not
+	// scramble the command line output
+	close(stop)
+	<-confirm
+
+	if len(orphans) == 0 {
+		fmt.Println("   No orphaned target files found. Leaving smsync ...")
+		log.Info("No orphaned target files found")
+		return nil
+	}
+
+	// print orphaned files
+	fmt.Println("\n:: Orphaned target files")
+	for _, f := range orphans {
+		rel, err := filepath.Rel(cfg.TrgDir.Path(), f)
+		if err != nil {
+			log.Error(err)
+			rel = f
+		}
+		fmt.Printf("   %s\n", rel)
+	}
+
+	// ask user for OK
+	if !cli.noConfirm {
+		if !msg.UserOK(fmt.Sprintf("\n:: Delete %d orphaned target files", len(orphans))) {
+			log.Infof("Pruning not started due to user input")
+			return nil
+		}
+	}
+
+	// delete orphaned files
+	if errs := smsync.Prune(cfg, orphans); errs > 0 {
+		return fmt.Errorf("%d orphaned target files could not be deleted", errs)
+	}
+	fmt.Printf("\n:: Done :)\n   Deleted %d orphaned target files\n", len(orphans))
+
+	return nil
+}
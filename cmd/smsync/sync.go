@@ -3,22 +3,27 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/eiannone/keyboard"
 	log "github.com/sirupsen/logrus"
-	"gitlab.com/go-utilities/file"
 	"gitlab.com/go-utilities/msg"
 	"gitlab.com/mipimipi/smsync/internal/smsync"
 )
 
-// listenStop waits for <ESC> pressed on keyboard as stop signal
+// listenStop waits for <ESC> pressed on keyboard as stop signal. Since the
+// keyboard is read in raw mode, <CTRL-C> doesn't trigger SIGINT but arrives
+// as key. It's treated like <ESC>
 func listenStop() (stop chan struct{}) {
 	stop = make(chan struct{})
 
 	go func() {
-		if _, key, _ := keyboard.GetSingleKey(); key == keyboard.KeyEsc {
+		if _, key, _ := keyboard.GetSingleKey(); key == keyboard.KeyEsc || key == keyboard.KeyCtrlC {
 			stop <- struct{}{}
 			close(stop)
 		}
@@ -30,7 +35,7 @@ func listenStop() (stop chan struct{}) {
 // process starts the processing of directories and file conversions. It also
 // calls the print functions to display the required information onthe command
 // line
-func process(cfg *smsync.Config, files *[]*file.Info, init bool, verbose bool) {
+func process(cfg *smsync.Config, wl *[]*smsync.WorkItem, init bool, verbose bool) {
 	log.Debug("cli.process: BEGIN")
 	defer log.Debug("cli.process: END")
 
@@ -41,7 +46,7 @@ func process(cfg *smsync.Config, files *[]*file.Info, init bool, verbose bool) {
 	)
 
 	// start processing
-	proc := smsync.NewProcess(cfg, files, init)
+	proc := smsync.NewProcess(cfg, wl, init)
 	proc.Run()
 
 	// channel for stop from keyboard. deferred close is necessary since if
@@ -50,6 +55,14 @@ func process(cfg *smsync.Config, files *[]*file.Info, init bool, verbose bool) {
 	defer keyboard.Close()
 	stop := listenStop()
 
+	// channel for SIGINT, SIGTERM and SIGHUP (e.g. if the terminal is closed
+	// or if smsync runs as systemd service and the service is stopped). The
+	// first signal stops the processing like <ESC>, a further signal aborts
+	// the running conversions
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
 	// print header (if the user doesn't want smsync to be verbose)
 	if !verbose {
 		printProgress(proc.Trck, true, false)
@@ -89,6 +102,14 @@ loop:
 				wantstop = true
 				proc.Stop()
 			}
+		case sig := <-sigs:
+			log.Infof("Signal '%v' received", sig)
+			if wantstop {
+				proc.Cancel()
+				continue
+			}
+			wantstop = true
+			proc.Stop()
 		}
 	}
 
@@ -99,6 +120,45 @@ loop:
 
 	// print final success message
 	printFinal(proc.Trck, verbose)
+
+	// print files that have not been synchronized due to low disk space
+	printSkipped(cfg, proc.Skipped())
+}
+
+// exclDirs returns the target directories of excluded source directories
+// that are contained in the work list wl
+func exclDirs(wl *[]*smsync.WorkItem) (dirs []string) {
+	for _, item := range *wl {
+		if item.Kind == smsync.ItemDeleteDir {
+			dirs = append(dirs, item.TrgFile)
+		}
+	}
+	return dirs
+}
+
+// dropExclDirs returns the work list wl without the deletions of the target
+// directories dirs of excluded source directories and without the deletions
+// of target files in these directories. Thus, their manifest entries are kept
+// and the deletion is proposed again in the next run
+func dropExclDirs(wl *[]*smsync.WorkItem, dirs []string) *[]*smsync.WorkItem {
+	// local function to determine whether path is located in one of dirs
+	inDirs := func(path string) bool {
+		for _, dir := range dirs {
+			if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	items := []*smsync.WorkItem{}
+	for _, item := range *wl {
+		if item.Kind == smsync.ItemDeleteDir || (item.Kind == smsync.ItemDelete && inDirs(item.TrgFile)) {
+			continue
+		}
+		items = append(items, item)
+	}
+	return &items
 }
 
 // synchronize is the main function of smsync. It triggers the entire sync
@@ -108,7 +168,7 @@ loop:
 // (3) start processing of these directories and files
 func synchronize(level log.Level, verbose bool) error {
 	// logger needs to be created before the first log entry is generated!!!
-	if err := smsync.CreateLogger(level); err != nil {
+	if err := smsync.CreateLogger(cli.target, level); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
 
@@ -120,14 +180,31 @@ func synchronize(level log.Level, verbose bool) error {
 
 	// read configuration
 	cfg := new(smsync.Config)
-	if err := cfg.Get(cli.init); err != nil {
+	if err := cfg.Get(cli.target, cli.config, cli.init); err != nil {
 		return err
 	}
 
-	// print summary and ask user for OK
+	// choose the conversions of rules with ladder such that the target files
+	// fit into the size budget (if there's one)
+	if cfg.Budget > 0 || cfg.FillDevice {
+		stop, confirm := msg.ProgressStr(":: Estimate target size (this can take a few minutes)", 1000)
+		err := smsync.FitBudget(cfg)
+		close(stop)
+		<-confirm
+		if err != nil {
+			return err
+		}
+	}
+
+	// print summary and ask user for OK. If conversions have been chosen to
+	// fit into the budget, the user confirms them as well
 	printCfgSummary(cfg)
-	if !cli.noConfirm {
-		if !msg.UserOK("\n:: Start synchronization") {
+	if !cli.noConfirm && !cli.dryRun {
+		question := "\n:: Start synchronization"
+		if cfg.Fit != nil {
+			question = "\n:: Start synchronization with these conversions"
+		}
+		if !msg.UserOK(question) {
 			log.Infof("Synchronization not started due to user input")
 			defer smsync.CleanUp(cfg)
 			return nil
@@ -140,16 +217,43 @@ func synchronize(level log.Level, verbose bool) error {
 	// start automatic progress string which increments every second
 	stop, confirm := msg.ProgressStr(":: Find differences (this can take a few minutes)", 1000)
 
-	// get files and directories that need to be synched
-	files := smsync.GetSyncFiles(cfg, cli.init)
+	// get files that need to be synched
+	wl := smsync.GetSyncFiles(cfg, cli.init, cli.dryRun)
 
 	// stop progress string and receive stop confirmation. The confirmation is necessary to not
 	// scramble the command line output
 	close(stop)
 	<-confirm
 
+	// the scope is determined together with the files, since it depends on
+	// the override files in the source tree
+	if cfg.ScopeChg && !cli.init {
+		fmt.Println("   Rules, exclusions or override files changed since last sync")
+	}
+
+	// display source files that cannot be synchronized since they are mapped
+	// to the same target file
+	printCollisions(cfg)
+
+	// in case of a dry run: print planned actions and exit
+	if cli.dryRun {
+		printPlan(cfg, wl, cli.init)
+		smsync.CleanUp(cfg)
+		return nil
+	}
+
+	// target directories of excluded source directories are only deleted
+	// after confirmation by the user
+	if dirs := exclDirs(wl); len(dirs) > 0 && !cli.noConfirm {
+		printExclDirs(cfg, dirs)
+		if !msg.UserOK(fmt.Sprintf("\n:: Delete these %d directories with their entire content", len(dirs))) {
+			log.Infof("Target directories of excluded source directories not deleted due to user input")
+			wl = dropExclDirs(wl, dirs)
+		}
+	}
+
 	// if no files need to be synchec: clean up and exit
-	if len(*files) == 0 {
+	if len(*wl) == 0 {
 		fmt.Println("   Nothing to synchronize. Leaving smsync ...")
 		log.Info("Nothing to synchronize")
 
@@ -158,7 +262,7 @@ func synchronize(level log.Level, verbose bool) error {
 
 	// print summary and ask user for OK to continue
 	if !cli.noConfirm {
-		if !msg.UserOK(fmt.Sprintf("\n:: %d files and directories to be synchronized. Continue", len(*files))) {
+		if !msg.UserOK(fmt.Sprintf("\n:: %d files to be synchronized. Continue", len(*wl))) {
 			log.Infof("Synchronization not started due to user input")
 			smsync.CleanUp(cfg)
 			return nil
@@ -167,7 +271,7 @@ func synchronize(level log.Level, verbose bool) error {
 
 	// do synchronization / conversion
 	fmt.Println("\n:: Synchronization / conversion (PRESS <ESC> TO STOP)")
-	process(cfg, files, cli.init, cli.verbose)
+	process(cfg, wl, cli.init, cli.verbose)
 
 	// everything's fine
 	return nil
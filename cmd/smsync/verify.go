@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/mipimipi/smsync/internal/smsync"
+)
+
+// verify compares the source and the target directory tree and displays the
+// discrepancies. Since nothing must be changed, a log file is only written if
+// the user requested it per cli option. If discrepancies are found, an error
+// is returned to get a non-zero exit code
+func verify(logging bool) error {
+	if logging {
+		// logger needs to be created before the first log entry is generated!!!
+		if err := smsync.CreateLogger(cli.target, log.DebugLevel); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	} else {
+		log.SetLevel(log.ErrorLevel)
+	}
+
+	log.Debug("cli.verify: BEGIN")
+	defer log.Debug("cli.verify: END")
+
+	// print copyright etc. on command line
+	fmt.Println(preamble)
+
+	// read configuration
+	cfg := new(smsync.Config)
+	if err := cfg.Get(cli.target, cli.config, false); err != nil {
+		return err
+	}
+	if logging {
+		defer smsync.CleanUp(cfg)
+	}
+
+	fmt.Println("\n:: Compare source and target (this can take a few minutes)")
+	discs := smsync.Verify(cfg)
+
+	if len(discs) == 0 {
+		fmt.Println("   Source and target are consistent :)")
+		return nil
+	}
+
+	labels := map[smsync.DiscKind]string{
+		smsync.DiscMissing:  "MISSING",
+		smsync.DiscOutdated: "OUTDATED",
+		smsync.DiscEmpty:    "EMPTY",
+		smsync.DiscSuffix:   "SUFFIX",
+		smsync.DiscNoSource: "NO SOURCE",
+	}
+	for _, d := range discs {
+		if d.SrcFile == "" {
+			fmt.Printf("   %-9s %s\n", labels[d.Kind], d.TrgFile)
+		} else {
+			fmt.Printf("   %-9s %s (source: %s)\n", labels[d.Kind], d.TrgFile, d.SrcFile)
+		}
+	}
+
+	return fmt.Errorf("\n:: %d discrepancies found", len(discs))
+}
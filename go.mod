@@ -14,6 +14,7 @@ require (
 	gitlab.com/go-utilities/strings v0.1.0
 	gitlab.com/go-utilities/time v0.1.0
 	gitlab.com/go-utilities/workerpool v0.1.0
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -21,5 +22,4 @@ require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/logrusorgru/aurora v2.0.3+incompatible // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 )
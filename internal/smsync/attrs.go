@@ -0,0 +1,129 @@
+package smsync
+
+// attrs.go implements the attributes of target files and directories:
+// Per default, target files get the time of their creation as modification
+// time. Optionally,
+// all target files get the modification time of their source file or of its
+// directory (i.e. the album). That's relevant for devices that sort music by
+// modification time ("recently added"). Furthermore, the permissions of
+// target files and directories can be configured.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+)
+
+// constants for the modification time of target files
+const (
+	TrgMTimeNow    = "now"    // time of the creation of the target file
+	TrgMTimeSource = "source" // modification time of the source file
+	TrgMTimeAlbum  = "album"  // modification time of the directory of the source file
+)
+
+// defDirMode are the permissions of target directories if no directory mode
+// is configured
+const defDirMode = 0755
+
+// parseMode parses the permissions s (an octal number such as '0644'). If s
+// is empty, 0 is returned
+func parseMode(s string) (os.FileMode, error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m == 0 || m > 0777 {
+		return 0, fmt.Errorf("'%s' is not a valid mode: an octal number between 0001 and 0777 is required", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// trgModTime returns the modification time that the target file of the
+// source file srcFile must get. If it's not determined by the configuration
+// (i.e. the target file keeps the time of its creation), false is returned
+func (cfg *Config) trgModTime(srcFile file.Info) (time.Time, bool) {
+	switch cfg.TrgMTime {
+	case TrgMTimeSource:
+		return srcFile.ModTime(), true
+	case TrgMTimeAlbum:
+		info, err := os.Stat(filepath.Dir(srcFile.Path()))
+		if err != nil {
+			log.Errorf("trgModTime: %v", err)
+			return srcFile.ModTime(), true
+		}
+		return info.ModTime(), true
+	}
+	return time.Time{}, false
+}
+
+// setTrgAttrs sets permissions and modification time of the file trgFile that
+// has been created for the source file srcFile according to the
+// configuration. Hard links are not changed since that would change the
+// source file as well
+func (cfg *Config) setTrgAttrs(srcFile file.Info, trgFile string) error {
+	info, err := os.Stat(trgFile)
+	if err != nil {
+		log.Errorf("setTrgAttrs: %v", err)
+		return err
+	}
+	if srcInfo, err := os.Stat(srcFile.Path()); err == nil && os.SameFile(srcInfo, info) {
+		return nil
+	}
+
+	if cfg.FileMode != 0 {
+		if err = os.Chmod(trgFile, cfg.FileMode); err != nil {
+			log.Errorf("setTrgAttrs: %v", err)
+			return err
+		}
+	}
+	if t, ok := cfg.trgModTime(srcFile); ok {
+		if err = os.Chtimes(trgFile, t, t); err != nil {
+			log.Errorf("setTrgAttrs: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// mkTrgDir creates the target directory dir and its parent directories if
+// they don't exist. Directories that are created get the configured directory
+// mode
+func (cfg *Config) mkTrgDir(dir string) error {
+	// determine the directories that need to be created
+	var dirs []string
+	for d := dir; len(d) > len(cfg.TrgDir.Path()); d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		dirs = append(dirs, d)
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	mode := os.FileMode(defDirMode)
+	if cfg.DirMode != 0 {
+		mode = cfg.DirMode
+	}
+	if err := file.MkdirAll(dir, os.ModeDir|mode); err != nil {
+		log.Errorf("mkTrgDir: %v", err)
+		return err
+	}
+	// MkdirAll applies the umask. Thus, the configured mode is set
+	// explicitly
+	if cfg.DirMode != 0 {
+		for _, d := range dirs {
+			if err := os.Chmod(d, cfg.DirMode); err != nil {
+				log.Errorf("mkTrgDir: %v", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package smsync
+
+// budget.go implements the capacity-fitting mode. Instead of a fixed
+// conversion, a rule can have a ladder of conversions (from the highest to the
+// lowest quality). If a size budget is configured, smsync chooses the highest
+// step of the ladders for which the estimated total size of the target files
+// fits into the budget. All ladders are descended together, i.e. in step i,
+// every rule with a ladder uses its i-th conversion (or its last one if the
+// ladder is shorter). The size of the target files is estimated per rule and
+// conversion: A few source files are converted as samples, the resulting
+// compression rate is applied to the total size of the source files of the
+// rule (like the estimation of the target size during processing). The
+// configured rules are not changed: The rules with the chosen conversions are
+// kept in the fit and returned by getCv.
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ricochet2200/go-disk-usage/du"
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+	fp "gitlab.com/go-utilities/filepath"
+)
+
+// budgetDevice is the budget that fills the target device
+const budgetDevice = "device"
+
+// numSamples is the maximum number of source files per rule and conversion
+// that are converted to estimate the compression rate
+const numSamples = 3
+
+// Sample conversions are repeated if the number or the total size of the
+// source files of a rule deviate by more than sampleTolerance from the values
+// at the time of the samples, or if the samples are older than sampleMaxAge
+// (e.g. since FFMPEG could have been updated in the meantime)
+const (
+	sampleTolerance = 0.1
+	sampleMaxAge    = 90 * 24 * time.Hour
+)
+
+// Fit contains the result of fitting the conversions into the size budget
+type Fit struct {
+	Budget uint64        // size budget for the target files in bytes
+	Size   uint64        // estimated total size of the target files with the chosen conversions
+	Step   int           // chosen step of the ladders (starting with 1)
+	Steps  int           // number of steps of the longest ladder
+	Fits   bool          // false if the target files don't fit into the budget even with the lowest step
+	cvs    map[*cvm]*cvm // rules with ladder and their copies with the chosen conversion
+}
+
+// ruleFiles contains the source files of a rule and their total size
+type ruleFiles struct {
+	files []file.Info
+	size  uint64
+}
+
+// FitBudget chooses the conversions of the rules with ladder such that the
+// estimated total size of the target files fits into the size budget. The
+// result (including the chosen conversions) is stored in cfg.Fit. If no
+// budget is configured, nothing is done
+func FitBudget(cfg *Config) error {
+	log.Debug("smsync.FitBudget: BEGIN")
+	defer log.Debug("smsync.FitBudget: END")
+
+	// the source files are assigned to the configured rules
+	cfg.Fit = nil
+
+	var ladders []*cvm
+	for _, cv := range cfg.Cvs {
+		if cv.ladder != nil {
+			ladders = append(ladders, cv)
+		}
+	}
+	if (cfg.Budget == 0 && !cfg.FillDevice) || len(ladders) == 0 {
+		return nil
+	}
+
+	budget := cfg.Budget
+	if cfg.FillDevice {
+		budget = deviceBudget(cfg)
+	}
+
+	// collect the source files in scope per rule. The size of copies is the
+	// size of the source files
+	filter := func(srcFile file.Info, vp file.ValidPropagate) (bool, file.ValidPropagate) {
+		ok, vpSub := inScope(cfg, srcFile)
+		return ok && !srcFile.IsDir(), vpSub
+	}
+	files, _ := cfg.findSrc(filter)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path() < files[j].Path() })
+
+	var (
+		rules  = make(map[*cvm]*ruleFiles)
+		copies uint64
+	)
+	for _, f := range files {
+		cv, ok := cfg.getCv(f.Path())
+		if !ok {
+			continue
+		}
+		if cv.NormCvStr == cvCopyStr {
+			copies += uint64(f.Size())
+			continue
+		}
+		if rules[cv] == nil {
+			rules[cv] = new(ruleFiles)
+		}
+		rules[cv].files = append(rules[cv].files, f)
+		rules[cv].size += uint64(f.Size())
+	}
+
+	// estimate the total size for every step of the ladders, starting with
+	// the highest one, until it fits into the budget
+	fit := &Fit{Budget: budget}
+	for _, cv := range ladders {
+		if len(cv.ladder) > fit.Steps {
+			fit.Steps = len(cv.ladder)
+		}
+	}
+	for step := 0; step < fit.Steps; step++ {
+		size := copies
+		for cv, rf := range rules {
+			cvStr := cv.NormCvStr
+			if cv.ladder != nil {
+				cvStr = cv.ladder[min(step, len(cv.ladder)-1)]
+			}
+			comp, err := cfg.sampleComp(cv, cvStr, rf)
+			if err != nil {
+				return err
+			}
+			size += uint64(comp * float64(rf.size))
+		}
+		fit.Size, fit.Step = size, step+1
+		if fit.Fits = size <= budget; fit.Fits {
+			break
+		}
+	}
+	if !fit.Fits {
+		log.Warningf("Estimated target size of %d MB exceeds the budget of %d MB even with the lowest conversions", fit.Size>>20, budget>>20)
+	}
+
+	// keep the chosen conversions
+	fit.cvs = make(map[*cvm]*cvm)
+	for _, cv := range ladders {
+		c := *cv
+		c.NormCvStr = cv.ladder[min(fit.Step-1, len(cv.ladder)-1)]
+		fit.cvs[cv] = &c
+		log.Infof("Conversion '%s' chosen for rule for '%s'", c.NormCvStr, cv.SrcSuffix)
+	}
+	cfg.Fit = fit
+
+	return nil
+}
+
+// deviceBudget determines the budget that fills the target device: It
+// consists of the free space, the size of the existing target files (since
+// they are replaced) minus the reserve of free space
+func deviceBudget(cfg *Config) uint64 {
+	budget := du.NewDiskUsage(cfg.TrgDir.Path()).Available()
+	for _, e := range cfg.mf.Entries {
+		budget += uint64(e.TrgSize)
+	}
+	if budget < cfg.MinFree {
+		return 0
+	}
+	return budget - cfg.MinFree
+}
+
+// fitted returns the rule with the conversion that has been chosen to fit
+// into the budget if cv has a ladder. Otherwise, cv is returned
+func (cfg *Config) fitted(cv *cvm) *cvm {
+	if cfg.Fit != nil {
+		if c, ok := cfg.Fit.cvs[cv]; ok {
+			return c
+		}
+	}
+	return cv
+}
+
+// CvStr returns the conversion of the rule cv, taking the conversions into
+// account that have been chosen to fit into the budget
+func (cfg *Config) CvStr(cv *cvm) string {
+	return cfg.fitted(cv).NormCvStr
+}
+
+// fresh returns true if the sample result s is still valid for the source
+// files files of a rule with total size size
+func (s *mfSample) fresh(files int, size uint64) bool {
+	t, err := time.Parse(time.RFC3339, s.Time)
+	if err != nil || time.Since(t) > sampleMaxAge {
+		return false
+	}
+	dev := func(a, b float64) bool { return math.Abs(a-b) > sampleTolerance*b }
+	return !dev(float64(files), float64(s.Files)) && !dev(float64(size), float64(s.SrcSize))
+}
+
+// sampleComp determines the compression rate of the conversion cvStr for
+// the source files rf of the rule cv. Up to numSamples files, evenly
+// distributed over the files, are converted. The result is stored in the
+// manifest and reused in subsequent runs as long as it's fresh
+func (cfg *Config) sampleComp(cv *cvm, cvStr string, rf *ruleFiles) (float64, error) {
+	key := strings.Join([]string{cv.SrcSuffix, cv.Path, cv.TrgSuffix, cvStr}, "|")
+	if s, ok := cfg.mf.sample(key); ok && s.fresh(len(rf.files), rf.size) {
+		return s.Comp, nil
+	}
+	files := rf.files
+
+	dir, err := os.MkdirTemp("", "smsync-samples-")
+	if err != nil {
+		log.Errorf("sampleComp: %v", err)
+		return 0, fmt.Errorf("sampleComp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var srcSize, trgSize int64
+	for i := 0; i < numSamples && i < len(files); i++ {
+		f := files[i*len(files)/min(numSamples, len(files))]
+		trgFile := filepath.Join(dir, fmt.Sprintf("%d.%s", i, cv.TrgSuffix))
+
+		log.Infof("Convert '%s' with '%s' as sample", f.Path(), cvStr)
+		conv := validCvs[cvKey{srcSuffix: normSuffix(fp.Suffix(f.Path())), trgSuffix: cv.TrgSuffix}]
+		if err := conv.exec(context.Background(), f.Path(), trgFile, cvStr); err != nil {
+			log.Errorf("sampleComp: Sample '%s' cannot be converted: %v", f.Path(), err)
+			continue
+		}
+		info, err := os.Stat(trgFile)
+		if err != nil {
+			log.Errorf("sampleComp: %v", err)
+			continue
+		}
+		srcSize += f.Size()
+		trgSize += info.Size()
+	}
+	if srcSize == 0 {
+		return 0, fmt.Errorf("Target size for conversion '%s' cannot be estimated: no sample could be converted", cvStr)
+	}
+
+	comp := float64(trgSize) / float64(srcSize)
+	cfg.mf.setSample(key, &mfSample{
+		Comp:    comp,
+		Files:   len(rf.files),
+		SrcSize: rf.size,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+	})
+	return comp, nil
+}
+
+// LadderDesc returns a description of the ladder of the conversion rule for
+// display purposes. If the rule doesn't have a ladder, an empty string is
+// returned
+func (c *cvm) LadderDesc() string {
+	if c.ladder == nil {
+		return ""
+	}
+	return "ladder: " + strings.Join(c.ladder, ", ")
+}
@@ -6,11 +6,14 @@ package smsync
 // file smsync.yaml (which is stored in the target directory).
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -26,43 +29,121 @@ const (
 	suffixStar = "*"           // wildcard for music file suffix
 )
 
+// Constants for change detection
+const (
+	ChgDetectMTime = "mtime" // compare size and modification time of source files
+	ChgDetectHash  = "hash"  // compare content hash of source files
+)
+
 // structure for conversion rule
 type rule struct {
 	Source     string `yaml:"source"`               // source file format
+	Path       string `yaml:"path,omitempty"`       // pattern for source paths the rule applies to
 	Target     string `yaml:"target,omitempty"`     // target file format
 	Conversion string `yaml:"conversion,omitempty"` // conversion string
+
+	// conditions: the conversion is only executed if the source file
+	// fulfills them. Otherwise the fallback is applied
+	MinSrcBitrate int    `yaml:"min_source_bitrate,omitempty"` // minimum bit rate of source file in kbps
+	MaxSrcBitrate int    `yaml:"max_source_bitrate,omitempty"` // maximum bit rate of source file in kbps
+	MinSampleRate int    `yaml:"min_sample_rate,omitempty"`    // minimum sample rate of source file in Hz
+	MaxSampleRate int    `yaml:"max_sample_rate,omitempty"`    // maximum sample rate of source file in Hz
+	Fallback      string `yaml:"fallback,omitempty"`           // copy (default) or skip
+
+	// conversions to choose from (highest quality first) to fit the target
+	// into the size budget
+	Ladder []string `yaml:"ladder,omitempty"`
 }
 
 // cfgYml is used to read from and write to the config yaml file
 type cfgYml struct {
-	SrcDir   string   `yaml:"source_dir"`          // source directory
-	Excludes []string `yaml:"exclude,omitempty"`   // exclude these directories
-	LastSync string   `yaml:"last_sync,omitempty"` // timestamp when the last sync happened
-	NumCPUs  int      `yaml:"num_cpus,omitempty"`  // number of CPUs that gool is allowed to use
-	NumWrkrs int      `yaml:"num_wrkrs,omitempty"` // number of worker Go routines to be created
-	Rules    []rule   `yaml:"rules"`               // conversion rules
+	Name       string   `yaml:"name,omitempty"`              // name of the target
+	SrcDir     string   `yaml:"source_dir"`                  // source directory
+	Includes   []string `yaml:"include,omitempty"`           // only synchronize these sub trees
+	Excludes   []string `yaml:"exclude,omitempty"`           // exclude these directories and files
+	LastSync   string   `yaml:"last_sync,omitempty"`         // timestamp when the last sync happened
+	Scope      string   `yaml:"scope,omitempty"`             // fingerprint of rules and exclusions of the last sync
+	NumCPUs    int      `yaml:"num_cpus,omitempty"`          // number of CPUs that gool is allowed to use
+	NumWrkrs   int      `yaml:"num_wrkrs,omitempty"`         // number of worker Go routines to be created
+	ChgDetect  string   `yaml:"change_detection,omitempty"`  // change detection mode (mtime or hash)
+	TrgFS      string   `yaml:"target_filesystem,omitempty"` // file system of the target (posix, vfat or exfat)
+	TrgPath    string   `yaml:"target_path,omitempty"`       // template for target paths based on tags
+	CollPolicy string   `yaml:"collision_policy,omitempty"`  // how to resolve target path collisions (first, lossless or rename)
+	Symlinks   string   `yaml:"symlinks,omitempty"`          // handling of symbolic links in the source tree (skip, follow or copy-link)
+	CopyMode   string   `yaml:"copy_mode,omitempty"`         // how copy rules create target files (copy, reflink, hardlink or auto)
+	TrgMTime   string   `yaml:"target_mtime,omitempty"`      // modification time of target files (now, source or album)
+	FileMode   string   `yaml:"file_mode,omitempty"`         // permissions of target files (octal)
+	DirMode    string   `yaml:"dir_mode,omitempty"`          // permissions of target directories (octal)
+	MinFree    string   `yaml:"min_free,omitempty"`          // free space on the target device that must be kept (e.g. 2GB)
+	Budget     string   `yaml:"budget,omitempty"`            // size budget for the target files (e.g. 32GB or device)
+	Order      string   `yaml:"order,omitempty"`             // processing order of conversions (path, newest, smallest or priority)
+	Priority   []string `yaml:"priority,omitempty"`          // directories that are processed first (order priority)
+	Rules      []rule   `yaml:"rules"`                       // conversion rules
 }
 
 // Config contains the enriched data that has been read from the config file
 type Config struct {
-	LastSync time.Time       // timestamp when the last sync happened
-	SrcDir   file.Info       // source directory
-	TrgDir   file.Info       // target directory
-	Excludes []string        // exclude these directories
-	NumCpus  int             // number of CPUs that gool is allowed to use
-	NumWrkrs int             // number of worker Go routines to be created
-	Cvs      map[string]*cvm // conversion rules
+	LastSync   time.Time      // timestamp when the last sync happened
+	Name       string         // name of the target
+	SrcDir     file.Info      // source directory
+	TrgDir     file.Info      // target directory
+	Includes   []string       // only synchronize these sub trees (patterns)
+	Excludes   []string       // exclude these directories and files (patterns)
+	NumCpus    int            // number of CPUs that gool is allowed to use
+	NumWrkrs   int            // number of worker Go routines to be created
+	ChgDetect  string         // change detection mode (mtime or hash)
+	TrgFS      string         // file system of the target (posix, vfat or exfat)
+	TrgPath    string         // template for target paths based on tags (empty: source layout is mirrored)
+	CollPolicy string         // how to resolve target path collisions (first, lossless or rename)
+	Symlinks   string         // handling of symbolic links in the source tree (skip, follow or copy-link)
+	CopyMode   string         // how copy rules create target files (copy, reflink, hardlink or auto)
+	TrgMTime   string         // modification time of target files (now, source or album)
+	FileMode   os.FileMode    // permissions of target files (0: default of ffmpeg or copy)
+	DirMode    os.FileMode    // permissions of target directories (0: default)
+	MinFree    uint64         // free space on the target device that must be kept in bytes (0: no reserve)
+	Budget     uint64         // size budget for the target files in bytes (0: no budget)
+	FillDevice bool           // the target files shall fill the target device
+	Fit        *Fit           // conversions chosen to fit into the budget (determined by FitBudget)
+	Order      string         // processing order of conversions (path, newest, smallest or priority)
+	Priority   []string       // directories that are processed first (patterns, order priority)
+	Cvs        []*cvm         // conversion rules (in the order of the config file)
+	ScopeChg   bool           // rules or exclusions have been changed since the last sync
+	Collisions []Collision    // source files that are mapped to the same target file (determined by GetSyncFiles)
+	scope      string         // fingerprint of rules, exclusions and override files
+	lastScope  string         // fingerprint of the last sync
+	cfgPath    string         // path of the config file
+	mf         *manifest      // sync manifest of the target directory
+	ovrs       *overrides     // effective settings of source directories with override files
+	trgTmpl    *pathTmpl      // parsed template for target paths (nil if there's none)
+	renames    map[string]int // source files with a disambiguating suffix due to a collision (and its number)
+	tags       *dirTags       // tags that determine the target folder per source directory
+	conds      condCache      // results of the evaluation of rule conditions in this run
 }
 
-// mapping of target suffix to conversion parameter string
+// conversion rule: mapping of source suffix (and optionally a path pattern)
+// to target suffix and conversion parameter string
 type cvm struct {
+	SrcSuffix string
+	Path      string // pattern for source paths (relative to the source directory)
 	TrgSuffix string
-	NormCvStr string // normalized conversion string (e.g. defaults are added)
+	NormCvStr string   // normalized conversion string (e.g. defaults are added)
+	cond      *cond    // conditions for the source file (nil if there are none)
+	ladder    []string // normalized conversion strings to choose from (nil if there's no ladder)
 }
 
-// Get reads the smsync configuration from the file ./SMSYNC.yaml and stores
-// the configuration values in the structure *config.
-func (cfg *Config) Get(init bool) error {
+// String returns the representation of a conversion rule that is stored in
+// the manifest
+func (c *cvm) String() string {
+	return c.TrgSuffix + "|" + c.NormCvStr
+}
+
+// Get reads the smsync configuration for the target directory trgDir and
+// stores the configuration values in the structure *config. If trgDir is
+// empty, the current working directory is taken as target directory. The
+// configuration is read from the file cfgPath. If cfgPath is empty, the file
+// smsync.yaml in the target directory is read. A relative cfgPath is
+// interpreted relative to the current working directory
+func (cfg *Config) Get(trgDir string, cfgPath string, init bool) error {
 	log.Debug("smsync.Config.Get: BEGIN")
 	defer log.Debug("smsync.Config.Get: END")
 
@@ -71,10 +152,33 @@ func (cfg *Config) Get(init bool) error {
 		err  error
 	)
 
+	// set target directory
+	if trgDir == "" {
+		if trgDir, err = os.Getwd(); err != nil {
+			log.Errorf("Config.Get: %v", err)
+			return fmt.Errorf("Config.Get: %v", err)
+		}
+	}
+	if trgDir, err = filepath.Abs(trgDir); err != nil {
+		log.Errorf("Config.Get: %v", err)
+		return fmt.Errorf("Config.Get: %v", err)
+	}
+	if cfg.TrgDir, err = getDir(trgDir); err != nil {
+		return err
+	}
+
+	// set path of config file
+	if cfgPath == "" {
+		cfg.cfgPath = filepath.Join(trgDir, cfgFile)
+	} else if cfg.cfgPath, err = filepath.Abs(cfgPath); err != nil {
+		log.Errorf("Config.Get: %v", err)
+		return fmt.Errorf("Config.Get: %v", err)
+	}
+
 	log.Info("Read config from file ...")
 
 	// read config from file
-	if err = cfgY.read(); err != nil {
+	if err = cfgY.read(cfg.cfgPath); err != nil {
 		return fmt.Errorf("Config.Get: %v", err)
 	}
 
@@ -83,14 +187,23 @@ func (cfg *Config) Get(init bool) error {
 		return fmt.Errorf("No source directory specified in config file")
 	}
 
+	// get name of the target. Default is the name of the target directory
+	if cfg.Name = cfgY.Name; cfg.Name == "" {
+		cfg.Name = filepath.Base(trgDir)
+	}
+
 	// check if the configured source dir exists and is a directory
-	if cfg.SrcDir, err = getDir(cfgY.SrcDir); err != nil {
+	if cfg.SrcDir, err = getDir(cfg.absPath(cfgY.SrcDir)); err != nil {
 		return err
 	}
 
-	// get directories that shall be excluded
-	if len(cfgY.Excludes) > 0 {
-		cfg.getExcludes(&cfgY.Excludes)
+	// get patterns of sub trees that shall be included and of directories
+	// and files that shall be excluded
+	if cfg.Includes, err = getPatterns(cfgY.Includes); err != nil {
+		return err
+	}
+	if cfg.Excludes, err = getPatterns(cfgY.Excludes); err != nil {
+		return err
 	}
 
 	// get number of CPU's (optional). Default is to use all available cpus
@@ -109,6 +222,143 @@ func (cfg *Config) Get(init bool) error {
 		cfg.NumWrkrs = cfgY.NumWrkrs
 	}
 
+	// get change detection mode (optional). Default is to compare size and
+	// modification time
+	switch cfgY.ChgDetect {
+	case "":
+		cfg.ChgDetect = ChgDetectMTime
+	case ChgDetectMTime, ChgDetectHash:
+		cfg.ChgDetect = cfgY.ChgDetect
+	default:
+		log.Errorf("'%s' is not a valid change detection mode", cfgY.ChgDetect)
+		return fmt.Errorf("'%s' is not a valid change detection mode (allowed: %s, %s)", cfgY.ChgDetect, ChgDetectMTime, ChgDetectHash)
+	}
+
+	// get file system of the target (optional). Target file and directory
+	// names are sanitized accordingly. Default is posix
+	switch strings.ToLower(cfgY.TrgFS) {
+	case "":
+		cfg.TrgFS = TrgFSPosix
+	case TrgFSPosix, TrgFSVFAT, TrgFSExFAT:
+		cfg.TrgFS = strings.ToLower(cfgY.TrgFS)
+	default:
+		log.Errorf("'%s' is not a valid target file system", cfgY.TrgFS)
+		return fmt.Errorf("'%s' is not a valid target file system (allowed: %s, %s, %s)", cfgY.TrgFS, TrgFSPosix, TrgFSVFAT, TrgFSExFAT)
+	}
+
+	// get template for target paths (optional). Per default, the folder
+	// structure of the source directory is mirrored
+	if cfg.TrgPath = strings.TrimSpace(cfgY.TrgPath); cfg.TrgPath != "" {
+		if cfg.trgTmpl, err = parseTmpl(cfg.TrgPath); err != nil {
+			log.Errorf("Config.Get: %v", err)
+			return err
+		}
+	}
+	cfg.tags = &dirTags{dirs: make(map[string]map[string]string)}
+
+	// get collision policy (optional). Per default, the first source file
+	// (in lexical order) is synchronized
+	switch strings.ToLower(cfgY.CollPolicy) {
+	case "":
+		cfg.CollPolicy = CollFirst
+	case CollFirst, CollLossless, CollRename:
+		cfg.CollPolicy = strings.ToLower(cfgY.CollPolicy)
+	default:
+		log.Errorf("'%s' is not a valid collision policy", cfgY.CollPolicy)
+		return fmt.Errorf("'%s' is not a valid collision policy (allowed: %s, %s, %s)", cfgY.CollPolicy, CollFirst, CollLossless, CollRename)
+	}
+
+	// get handling of symbolic links (optional). Per default, they are
+	// skipped. Links cannot be created on vfat and exFAT, and links to
+	// directories require that the target tree mirrors the source tree
+	switch strings.ToLower(cfgY.Symlinks) {
+	case "":
+		cfg.Symlinks = SymlinksSkip
+	case SymlinksSkip, SymlinksFollow, SymlinksCopy:
+		cfg.Symlinks = strings.ToLower(cfgY.Symlinks)
+	default:
+		log.Errorf("'%s' is not a valid handling of symbolic links", cfgY.Symlinks)
+		return fmt.Errorf("'%s' is not a valid handling of symbolic links (allowed: %s, %s, %s)", cfgY.Symlinks, SymlinksSkip, SymlinksFollow, SymlinksCopy)
+	}
+	if cfg.Symlinks == SymlinksCopy && (isFAT(cfg.TrgFS) || cfg.trgTmpl != nil) {
+		log.Errorf("symlinks: %s cannot be combined with target_filesystem: %s or target_path", SymlinksCopy, cfg.TrgFS)
+		return fmt.Errorf("symlinks: %s cannot be combined with target_filesystem: %s or target_path", SymlinksCopy, cfg.TrgFS)
+	}
+
+	// get copy mode (optional). Per default, files are copied
+	switch strings.ToLower(cfgY.CopyMode) {
+	case "":
+		cfg.CopyMode = CopyModeCopy
+	case CopyModeCopy, CopyModeReflink, CopyModeHardlink, CopyModeAuto:
+		cfg.CopyMode = strings.ToLower(cfgY.CopyMode)
+	default:
+		log.Errorf("'%s' is not a valid copy mode", cfgY.CopyMode)
+		return fmt.Errorf("'%s' is not a valid copy mode (allowed: %s, %s, %s, %s)", cfgY.CopyMode, CopyModeCopy, CopyModeReflink, CopyModeHardlink, CopyModeAuto)
+	}
+
+	// get modification time of target files (optional). Per default,
+	// converted files get the current time
+	switch strings.ToLower(cfgY.TrgMTime) {
+	case "":
+		cfg.TrgMTime = TrgMTimeNow
+	case TrgMTimeNow, TrgMTimeSource, TrgMTimeAlbum:
+		cfg.TrgMTime = strings.ToLower(cfgY.TrgMTime)
+	default:
+		log.Errorf("'%s' is not a valid modification time of target files", cfgY.TrgMTime)
+		return fmt.Errorf("'%s' is not a valid modification time of target files (allowed: %s, %s, %s)", cfgY.TrgMTime, TrgMTimeNow, TrgMTimeSource, TrgMTimeAlbum)
+	}
+
+	// get permissions of target files and directories (optional)
+	if cfg.FileMode, err = parseMode(cfgY.FileMode); err != nil {
+		log.Errorf("file_mode: %v", err)
+		return fmt.Errorf("file_mode: %v", err)
+	}
+	if cfg.DirMode, err = parseMode(cfgY.DirMode); err != nil {
+		log.Errorf("dir_mode: %v", err)
+		return fmt.Errorf("dir_mode: %v", err)
+	}
+
+	// get reserve of free space on the target device (optional)
+	if cfgY.MinFree != "" {
+		if cfg.MinFree, err = parseSize(cfgY.MinFree); err != nil {
+			log.Errorf("min_free: %v", err)
+			return fmt.Errorf("min_free: %v", err)
+		}
+	}
+
+	// get size budget (optional). It's either a size or the entire target
+	// device
+	if strings.ToLower(strings.TrimSpace(cfgY.Budget)) == budgetDevice {
+		cfg.FillDevice = true
+	} else if cfgY.Budget != "" {
+		if cfg.Budget, err = parseSize(cfgY.Budget); err != nil || cfg.Budget == 0 {
+			log.Errorf("budget: '%s' is not a valid budget", cfgY.Budget)
+			return fmt.Errorf("budget: '%s' is not a valid budget (allowed: a size such as 32GB or %s)", cfgY.Budget, budgetDevice)
+		}
+	}
+
+	// get processing order (optional). Per default, albums are processed in
+	// the order of their path. A priority list implies order priority
+	if cfg.Priority, err = getPatterns(cfgY.Priority); err != nil {
+		return err
+	}
+	switch strings.ToLower(cfgY.Order) {
+	case "":
+		cfg.Order = OrderPath
+		if len(cfg.Priority) > 0 {
+			cfg.Order = OrderPriority
+		}
+	case OrderPath, OrderNewest, OrderSmallest, OrderPriority:
+		cfg.Order = strings.ToLower(cfgY.Order)
+	default:
+		log.Errorf("'%s' is not a valid processing order", cfgY.Order)
+		return fmt.Errorf("'%s' is not a valid processing order (allowed: %s, %s, %s, %s)", cfgY.Order, OrderPath, OrderNewest, OrderSmallest, OrderPriority)
+	}
+	if cfg.Order == OrderPriority && len(cfg.Priority) == 0 {
+		log.Errorf("order: %s requires a priority list", OrderPriority)
+		return fmt.Errorf("order: %s requires a priority list", OrderPriority)
+	}
+
 	// get last sync time. If an initial sync was requested by the user (i.e.
 	// init = true), nothing needs to be done)
 	if !init {
@@ -116,77 +366,157 @@ func (cfg *Config) Get(init bool) error {
 	}
 
 	// get rules
-	var hasRule = false             // determine if there's at least one rule
-	cfg.Cvs = make(map[string]*cvm) // allocate conversion map in config struct
+	var hasRule = false // determine if there's at least one rule
 	for i, r := range cfgY.Rules {
 		var c *cvm
 
-		c, err = cfg.getRule(&r, i+1)
+		c, err = getRule(cfg.Cvs, &r, i+1)
 		if err != nil {
 			return err
 		}
-		cfg.Cvs[r.Source] = c
+		cfg.Cvs = append(cfg.Cvs, c)
 		hasRule = true
 	}
 
+	// override files in the source tree are read when needed
+	cfg.ovrs = newOvrs()
+
 	// raise error if no rules could be detected
 	if !hasRule {
 		log.Error("No conversion rules could be detected in config file")
 		return fmt.Errorf("No conversion rules could be detected in config file")
 	}
 
-	// set target directory
-	trgDir, err := os.Getwd()
-	if err != nil {
-		log.Errorf("Config.Get: %v", err)
-		return fmt.Errorf("Config.Get: %v", err)
-	}
-	if cfg.TrgDir, err = file.Stat(trgDir); err != nil {
-		log.Errorf("Config.Get: %v", err)
-		return fmt.Errorf("Config.Get: %v", err)
+	// whether the scope has been changed since the last sync is determined
+	// by GetSyncFiles, since the fingerprint includes the override files in
+	// the source tree
+	cfg.lastScope = cfgY.Scope
+
+	// read manifest. If an initial sync was requested by the user, the
+	// manifest is ignored since the target directory will be emptied
+	if init {
+		cfg.mf = newMf(cfg.TrgDir.Path())
+	} else {
+		if cfg.mf, err = readMf(cfg.TrgDir.Path()); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// absPath returns path as absolute path. Relative paths are interpreted
+// relative to the target directory
+func (cfg *Config) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cfg.TrgDir.Path(), path)
+}
+
+// fingerprint calculates a hash value of the effective rules, inclusions and
+// exclusions, of the settings that determine target paths and of the override
+// files that have been read. It's stored in the config file after a sync and
+// used to detect changes of the scope in the next run
+func (cfg *Config) fingerprint() string {
+	var a []string
+
+	for _, cv := range cfg.Cvs {
+		s := "rule:" + cv.SrcSuffix + "|" + cv.String()
+		if cv.ladder != nil {
+			// the conversion of a rule with ladder depends on the budget
+			s = "rule:" + cv.SrcSuffix + "|" + cv.TrgSuffix + "|ladder:" + strings.Join(cv.ladder, ",")
+		}
+		if cv.Path != "" {
+			s += "|path:" + cv.Path
+		}
+		if cv.cond != nil {
+			s += "|" + cv.cond.String()
+		}
+		a = append(a, s)
+	}
+	for _, incl := range cfg.Includes {
+		a = append(a, "include:"+incl)
+	}
+	for _, excl := range cfg.Excludes {
+		a = append(a, "exclude:"+excl)
+	}
+	if cfg.Symlinks != SymlinksSkip {
+		a = append(a, "symlinks:"+cfg.Symlinks)
+	}
+	if cfg.TrgFS != TrgFSPosix {
+		a = append(a, "target_filesystem:"+cfg.TrgFS)
+	}
+	if cfg.TrgPath != "" {
+		a = append(a, "target_path:"+cfg.TrgPath)
+	}
+	if cfg.CollPolicy != CollFirst {
+		a = append(a, "collision_policy:"+cfg.CollPolicy)
+	}
+	cfg.ovrs.mu.Lock()
+	for dir, sum := range cfg.ovrs.sums {
+		a = append(a, "override:"+dir+"|"+sum)
+	}
+	cfg.ovrs.mu.Unlock()
+	sort.Strings(a)
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(a, "\n"))))
+}
+
 // getCv checks if the smsync conf contains a conversion rule for a given file.
-// It does so by retrieving a cvm structure for that file path. In case it could be
+// It does so by retrieving a cvm structure for that file path. The rules of
+// override files in the source tree are taken into account. The rules are
+// evaluated in their order, the first rule whose source suffix and path
+// pattern match wins. Rules for suffix '*' are only taken if no rule for the
+// suffix of the file matches. For rules with ladder, the rule with the
+// conversion that has been chosen to fit into the budget is returned. If the
+// rule has conditions that the file doesn't fulfill, the fallback of the rule
+// is returned. In case it could be
 // retrieved, a pointer to the cvm structure and true is returned, otherwise
 // nil and false
 func (cfg *Config) getCv(f string) (*cvm, bool) {
-	if _, ok := cfg.Cvs[fp.Suffix(f)]; ok {
-		return cfg.Cvs[fp.Suffix(f)], true
-	}
-	if _, ok := cfg.Cvs[suffixStar]; ok {
-		return cfg.Cvs[suffixStar], true
+	var (
+		rel    = relPath(cfg.SrcDir.Path(), f)
+		suffix = normSuffix(fp.Suffix(f))
+		star   *cvm
+	)
+
+	for _, cv := range cfg.dirOvr(filepath.Dir(f)).cvs {
+		if cv.Path != "" && !matchTree(cv.Path, rel) {
+			continue
+		}
+		if cv.SrcSuffix == suffix {
+			return cfg.applyCond(cfg.fitted(cv), f)
+		}
+		if cv.SrcSuffix == suffixStar && star == nil {
+			star = cv
+		}
 	}
-	return nil, false
+	return star, star != nil
 }
 
-// getExcludes expands the directories specified in the config file (which) can
-// contain wildcards
-func (cfg *Config) getExcludes(excls *[]string) {
-	log.Debug("smsync.Config.getExcludes: BEGIN")
-	defer log.Debug("smsync.Config.getExcludes: END")
+// getPatterns verifies the inclusion or exclusion patterns ps from the config
+// file. Empty patterns are skipped
+func getPatterns(ps []string) ([]string, error) {
+	var a []string
 
-	for _, excl := range *excls {
-		if excl == "" {
+	for _, p := range ps {
+		if p == "" || p == "." {
 			continue
 		}
-
-		// expand directory
-		a, err := filepath.Glob(fp.EscapePattern(filepath.Join(cfg.SrcDir.Path(), excl)))
-		if err != nil {
-			log.Errorf("Config.getExcludes: %v", err)
-			return
+		if err := checkPattern(p); err != nil {
+			log.Errorf("getPatterns: %v", err)
+			return nil, err
 		}
-		cfg.Excludes = append(cfg.Excludes, a...)
+		a = append(a, p)
 	}
+	return a, nil
 }
 
 // getRule verifies that r represents a valid rule and create the
-// corresponding mapping structure cvm
-func (cfg *Config) getRule(r *rule, i int) (*cvm, error) {
+// corresponding mapping structure cvm. cvs contains the rules that have been
+// read before from the same file
+func getRule(cvs []*cvm, r *rule, i int) (*cvm, error) {
 	log.Debug("smsync.Config.getRule: BEGIN")
 	defer log.Debug("smsync.Config.getRule: END")
 
@@ -201,12 +531,36 @@ func (cfg *Config) getRule(r *rule, i int) (*cvm, error) {
 		return nil, fmt.Errorf("No source suffix in rule #%d", i)
 	}
 
+	// suffixes are case-insensitive and aliases are replaced by the canonical
+	// suffix
+	r.Source = normSuffix(r.Source)
+	r.Target = normSuffix(r.Target)
+
+	// check path pattern
+	if r.Path != "" {
+		r.Path = path.Clean(r.Path)
+		if err = checkPattern(r.Path); err != nil {
+			log.Errorf("Rule #%d: %v", i, err)
+			return nil, fmt.Errorf("Rule #%d: %v", i, err)
+		}
+	}
+
 	// get target suffix
 	if len(r.Target) == 0 {
 		log.Infof("Rule #%d: Since no target suffix could be detected, target suffix will be set to source suffix", i)
 		r.Target = r.Source
 	}
 
+	// a ladder replaces the conversion. Its first step is validated like a
+	// conversion, the other steps are validated below
+	if len(r.Ladder) > 0 {
+		if r.Conversion != "" {
+			log.Errorf("Rule #%d: conversion and ladder cannot be combined", i)
+			return nil, fmt.Errorf("Rule #%d: conversion and ladder cannot be combined", i)
+		}
+		r.Conversion = r.Ladder[0]
+	}
+
 	// check conversion
 	if len(r.Conversion) == 0 {
 		log.Infof("Rule #%d: No conversion", i)
@@ -239,34 +593,58 @@ func (cfg *Config) getRule(r *rule, i int) (*cvm, error) {
 			log.Errorf("Rule #%d: copy is only supported is source end target suffix are equal", i)
 			return nil, fmt.Errorf("Rule #%d: copy is only supported is source end target suffix are equal", i)
 		}
-		return &cvm{TrgSuffix: r.Target, NormCvStr: cvCopyStr}, nil
+		normCvStr = cvCopyStr
+	} else {
+		if _, ok := validCvs[cvKey{r.Source, r.Target}]; !ok {
+			log.Errorf("Rule #%d: conversion of '%s' into '%s' not supported", i, r.Source, r.Target)
+			return nil, fmt.Errorf("Rule #%d: conversion of '%s' into '%s' not supported", i, r.Source, r.Target)
+		}
+
+		// validate conversion string and convert string to FFMpeg parameters
+		if normCvStr, err = validCvs[cvKey{r.Source, r.Target}].normCvStr(r.Conversion); err != nil {
+			log.Errorf("Rule #%d: '%s' is not a valid conversion", i, r.Conversion)
+			return nil, fmt.Errorf("Rule #%d: '%s' is not a valid conversion", i, r.Conversion)
+		}
 	}
 
-	if _, ok := validCvs[cvKey{r.Source, r.Target}]; !ok {
-		log.Errorf("Rule #%d: conversion of '%s' into '%s' not supported", i, r.Source, r.Target)
-		return nil, fmt.Errorf("Rule #%d: conversion of '%s' into '%s' not supported", i, r.Source, r.Target)
+	// validate and normalize the steps of the ladder
+	var ladder []string
+	if len(r.Ladder) > 0 {
+		if normCvStr == cvCopyStr {
+			log.Errorf("Rule #%d: copy is not supported in ladders", i)
+			return nil, fmt.Errorf("Rule #%d: copy is not supported in ladders", i)
+		}
+		for _, step := range r.Ladder {
+			s, err := validCvs[cvKey{r.Source, r.Target}].normCvStr(step)
+			if err != nil {
+				log.Errorf("Rule #%d: '%s' is not a valid conversion", i, step)
+				return nil, fmt.Errorf("Rule #%d: '%s' is not a valid conversion", i, step)
+			}
+			ladder = append(ladder, s)
+		}
 	}
 
-	// validate conversion string and convert string to FFMpeg parameters
-	if normCvStr, err = validCvs[cvKey{r.Source, r.Target}].normCvStr(r.Conversion); err != nil {
-		log.Errorf("Rule #%d: '%s' is not a valid conversion", i, r.Conversion)
-		return nil, fmt.Errorf("Rule #%d: '%s' is not a valid conversion", i, r.Conversion)
+	// validate that there's only one rule per source suffix and path pattern
+	for _, cv := range cvs {
+		if cv.SrcSuffix == r.Source && cv.Path == r.Path {
+			log.Errorf("Rule #%d: There's already a rule for source suffix '%s' and path '%s'", i, r.Source, r.Path)
+			return nil, fmt.Errorf("Rule #%d: There's already a rule for source suffix '%s' and path '%s'", i, r.Source, r.Path)
+		}
 	}
 
-	// validate that there's only one rule per source suffix
-	if _, ok := cfg.Cvs[r.Source]; ok {
-		log.Errorf("Rule #%d: There's already a rule for source suffix '%s'", i, r.Source)
-		return nil, fmt.Errorf("Rule #%d: There's already a rule for source suffix '%s'", i, r.Source)
+	// get conditions
+	c, err := getCond(r, i)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Infof("Rule #%d: '%s' is a valid conversion", i, r.Conversion)
 	log.Infof("Rule #%d: Conversion string normalized to '%s'", i, normCvStr)
-	return &cvm{TrgSuffix: r.Target, NormCvStr: normCvStr}, nil
+	return &cvm{SrcSuffix: r.Source, Path: r.Path, TrgSuffix: r.Target, NormCvStr: normCvStr, cond: c, ladder: ladder}, nil
 }
 
 // setProcEnd updates the file smsync.yaml after the conversions have ended
-// successfully. It sets the last sync time and removes the "wip" (work in
-// progress).
+// successfully. It sets the last sync time and the scope fingerprint.
 func (cfg *Config) setProcEnd() {
 	log.Debug("smsync.Config.setProcEnd: BEGIN")
 	defer log.Debug("smsync.Config.setProcEnd: END")
@@ -274,34 +652,50 @@ func (cfg *Config) setProcEnd() {
 	var cfgY cfgYml
 
 	// read config from file
-	if err := cfgY.read(); err != nil {
+	if err := cfgY.read(cfg.cfgPath); err != nil {
 		log.Errorf("cfgYml.serProcEnd: %v", err)
 	}
 
 	// set last sync time to current time in UTC
 	cfgY.LastSync = time.Now().UTC().Format(time.RFC3339)
 
+	// set scope fingerprint
+	cfgY.Scope = cfg.scope
+
 	// write config to file
-	cfgY.write()
+	cfgY.write(cfg.cfgPath)
 
 	log.Debug("Config.setProcEnd(): Config has been saved")
 }
 
-// readCfg read the configuration from the file smsync.yaml in the current directory
-func (cfgY *cfgYml) read() error {
+// setScope updates the scope fingerprint in the file smsync.yaml. It's used if
+// the scope has been changed but nothing needs to be synchronized
+func (cfg *Config) setScope() {
+	log.Debug("smsync.Config.setScope: BEGIN")
+	defer log.Debug("smsync.Config.setScope: END")
+
+	var cfgY cfgYml
+
+	// read config from file
+	if err := cfgY.read(cfg.cfgPath); err != nil {
+		log.Errorf("cfgYml.setScope: %v", err)
+		return
+	}
+
+	cfgY.Scope = cfg.scope
+	cfgY.write(cfg.cfgPath)
+}
+
+// read reads the configuration from the file cfgPath
+func (cfgY *cfgYml) read(cfgPath string) error {
 	log.Debug("smsync.cfgYml.read: BEGIN")
 	defer log.Debug("smsync.cfgYml.read: END")
 
 	// read config file
-	cfgFile, err := os.ReadFile(filepath.Join(".", cfgFile))
+	cfgFile, err := os.ReadFile(cfgPath)
 	if err != nil {
-		// determine working directory for error message
-		wd, err0 := os.Getwd()
-		if err0 != nil {
-			log.Errorf("cfgYml.read: %v", err0)
-			return err
-		}
-		return fmt.Errorf("No configuration file found in '%s'", wd)
+		log.Errorf("cfgYml.read: %v", err)
+		return fmt.Errorf("No configuration file '%s' found", cfgPath)
 	}
 	if err = yaml.Unmarshal(cfgFile, &cfgY); err != nil {
 		log.Errorf("cfgYml.read: %v", err)
@@ -310,6 +704,9 @@ func (cfgY *cfgYml) read() error {
 
 	// clean directory names
 	cfgY.SrcDir = path.Clean(cfgY.SrcDir)
+	for i := range cfgY.Includes {
+		cfgY.Includes[i] = path.Clean(cfgY.Includes[i])
+	}
 	for i := range cfgY.Excludes {
 		cfgY.Excludes[i] = path.Clean(cfgY.Excludes[i])
 	}
@@ -317,8 +714,8 @@ func (cfgY *cfgYml) read() error {
 	return nil
 }
 
-// write writes the configuration to the file smsync.yaml in the current directory
-func (cfgY *cfgYml) write() {
+// write writes the configuration to the file cfgPath
+func (cfgY *cfgYml) write(cfgPath string) {
 	log.Debug("smsync.cfgYml.write: BEGIN")
 	defer log.Debug("smsync.cfgYml.write: END")
 
@@ -333,7 +730,7 @@ func (cfgY *cfgYml) write() {
 		return
 	}
 
-	if err := os.WriteFile(filepath.Join(".", cfgFile), out, 0777); err != nil {
+	if err := os.WriteFile(cfgPath, out, 0777); err != nil {
 		log.Errorf("cfgYml.write: %v", err)
 		return
 	}
@@ -0,0 +1,134 @@
+package smsync
+
+// collision.go implements the handling of target path collisions, i.e. of
+// source files that are mapped to the same target file. This happens if the
+// names of source files only differ in the suffix (e.g. song.flac and
+// song.mp3 with rules that convert both to mp3), in characters that are not
+// supported by the target file system, or if a target path template creates
+// the same path for several source files. Collisions are detected before the
+// processing starts. The collision policy of the target determines how they
+// are resolved.
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	fp "gitlab.com/go-utilities/filepath"
+)
+
+// constants for the collision policy
+const (
+	CollFirst    = "first"    // first source file (in lexical order) is synchronized, the others are skipped
+	CollLossless = "lossless" // like first, but lossless source files take precedence
+	CollRename   = "rename"   // all source files are synchronized, target files get a disambiguating suffix
+)
+
+// losslessSuffixes contains the suffixes of lossless audio formats
+var losslessSuffixes = map[string]bool{
+	"aif":  true,
+	"ape":  true,
+	"dff":  true,
+	"dsf":  true,
+	"flac": true,
+	"tta":  true,
+	"wav":  true,
+	"wv":   true,
+}
+
+// Collision describes source files that are mapped to the same target file
+type Collision struct {
+	TrgFile  string   // target file (relative to the target directory)
+	SrcFiles []string // source files (relative to the source directory) in the order of precedence
+	TrgFiles []string // target file per source file (empty if the source file is skipped)
+}
+
+// collOrder sorts the source files srcRels by precedence according to the
+// collision policy
+func collOrder(policy string, srcRels []string) []string {
+	s := append([]string{}, srcRels...)
+	sort.Strings(s)
+	if policy == CollLossless {
+		sort.SliceStable(s, func(i, j int) bool {
+			return losslessSuffixes[normSuffix(fp.Suffix(s[i]))] && !losslessSuffixes[normSuffix(fp.Suffix(s[j]))]
+		})
+	}
+	return s
+}
+
+// resolveCollisions resolves target path collisions according to the
+// collision policy and stores them in cfg.Collisions. keys contains the source
+// files (relative to the source directory) per collision key of their target
+// file. Source files with the same key collide. Per collision, the source
+// file with the highest precedence keeps the target file. In case of policy
+// rename, the other source files get a disambiguating suffix (which is applied
+// by assembleTrgFile). The suffix is chosen such that the resulting target
+// file is not claimed by another source file. Otherwise, the other source
+// files are returned as source files that must be skipped
+func resolveCollisions(cfg *Config, keys map[string][]string) (skip map[string]bool) {
+	skip = make(map[string]bool)
+	cfg.Collisions = nil
+	cfg.renames = make(map[string]int)
+
+	// collect collisions and sort them to get deterministic results
+	var groups [][]string
+	for _, srcRels := range keys {
+		if len(srcRels) > 1 {
+			groups = append(groups, srcRels)
+		}
+	}
+	for _, group := range groups {
+		sort.Strings(group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+
+	// taken contains the collision keys of target files that have been
+	// assigned to renamed source files
+	taken := make(map[string]bool)
+
+	for _, group := range groups {
+		srcRels := collOrder(cfg.CollPolicy, group)
+		c := Collision{
+			TrgFile:  relPath(cfg.TrgDir.Path(), assembleTrgFile(cfg, filepath.Join(cfg.SrcDir.Path(), srcRels[0]))),
+			SrcFiles: srcRels,
+			TrgFiles: []string{""},
+		}
+		c.TrgFiles[0] = c.TrgFile
+
+		for _, srcRel := range srcRels[1:] {
+			if cfg.CollPolicy != CollRename {
+				log.Errorf("'%s' is not synchronized since it's mapped to the same target file '%s' as '%s'", srcRel, c.TrgFile, srcRels[0])
+				skip[srcRel] = true
+				c.TrgFiles = append(c.TrgFiles, "")
+				continue
+			}
+			var trgRel string
+			for n := 2; ; n++ {
+				cfg.renames[srcRel] = n
+				trgRel = relPath(cfg.TrgDir.Path(), assembleTrgFile(cfg, filepath.Join(cfg.SrcDir.Path(), srcRel)))
+				k := collKey(cfg.TrgFS, trgRel)
+				if _, claimed := keys[k]; !claimed && !taken[k] {
+					taken[k] = true
+					break
+				}
+			}
+			log.Warningf("'%s' is mapped to the same target file '%s' as '%s': it's stored as '%s'", srcRel, c.TrgFile, srcRels[0], trgRel)
+			c.TrgFiles = append(c.TrgFiles, trgRel)
+		}
+
+		cfg.Collisions = append(cfg.Collisions, c)
+	}
+
+	return skip
+}
+
+// renameSuffix returns the disambiguating suffix for the source file srcRel
+// (relative to the source directory), or an empty string if srcRel doesn't
+// need one
+func (cfg *Config) renameSuffix(srcRel string) string {
+	if n := cfg.renames[srcRel]; n > 0 {
+		return fmt.Sprintf(" (%d)", n)
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package smsync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollOrder(t *testing.T) {
+	tests := []struct {
+		policy  string
+		srcRels []string
+		want    []string
+	}{
+		{CollFirst, []string{"a/song.mp3", "a/song.flac"}, []string{"a/song.flac", "a/song.mp3"}},
+		{CollRename, []string{"b/x.ogg", "a/x.mp3"}, []string{"a/x.mp3", "b/x.ogg"}},
+		{CollLossless, []string{"a/song.flac", "a/song.aac"}, []string{"a/song.flac", "a/song.aac"}},
+		{CollLossless, []string{"a/song.mp3", "a/song.WAV"}, []string{"a/song.WAV", "a/song.mp3"}},
+		{CollLossless, []string{"b/x.wv", "a/x.ogg", "a/x.flac"}, []string{"a/x.flac", "b/x.wv", "a/x.ogg"}},
+	}
+
+	for _, tt := range tests {
+		srcRels := append([]string{}, tt.srcRels...)
+		if got := collOrder(tt.policy, srcRels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("collOrder(%s, %v) = %v, want %v", tt.policy, tt.srcRels, got, tt.want)
+		}
+		if !reflect.DeepEqual(srcRels, tt.srcRels) {
+			t.Errorf("collOrder(%s, %v) changed its input", tt.policy, tt.srcRels)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package smsync
+
+// condition.go implements conditions of conversion rules. Conditions refer to
+// properties of the source file (bit rate, sample rate) that are determined
+// with ffprobe. If the conditions of a rule are not met for a source file,
+// the fallback of the rule is applied instead of the conversion: the source
+// file is either copied or skipped.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+)
+
+// constants for the fallback of rule conditions
+const (
+	fallbackCopy = "copy" // copy source file instead of converting it
+	fallbackSkip = "skip" // ignore source file
+)
+
+// condKey identifies the evaluation of the conditions of a conversion rule
+// for a source file
+type condKey struct {
+	cv   *cvm   // conversion rule
+	path string // path of the source file
+}
+
+// condRes is the result of applyCond
+type condRes struct {
+	cv *cvm
+	ok bool
+}
+
+// condCache caches the results of applyCond for the current run, since the
+// conversion rule of a source file is needed several times and the
+// evaluation of conditions requires the properties of the source file
+type condCache struct {
+	res map[condKey]condRes
+	mu  sync.Mutex
+}
+
+// cond contains the conditions of a conversion rule
+type cond struct {
+	minBitrate    int    // minimum bit rate of source file in kbps
+	maxBitrate    int    // maximum bit rate of source file in kbps
+	minSampleRate int    // minimum sample rate of source file in Hz
+	maxSampleRate int    // maximum sample rate of source file in Hz
+	fallback      string // what to do if conditions are not met
+}
+
+// getCond verifies the conditions of the rule r and creates the corresponding
+// cond structure. If r has no conditions, nil is returned
+func getCond(r *rule, i int) (*cond, error) {
+	c := cond{
+		minBitrate:    r.MinSrcBitrate,
+		maxBitrate:    r.MaxSrcBitrate,
+		minSampleRate: r.MinSampleRate,
+		maxSampleRate: r.MaxSampleRate,
+		fallback:      strings.Trim(strings.ToLower(r.Fallback), " "),
+	}
+
+	if c.minBitrate == 0 && c.maxBitrate == 0 && c.minSampleRate == 0 && c.maxSampleRate == 0 {
+		if c.fallback != "" {
+			log.Errorf("Rule #%d: A fallback requires at least one condition", i)
+			return nil, fmt.Errorf("Rule #%d: A fallback requires at least one condition", i)
+		}
+		return nil, nil
+	}
+	if r.Source == suffixStar {
+		log.Errorf("Rule #%d: Conditions are not supported for suffix '*'", i)
+		return nil, fmt.Errorf("Rule #%d: Conditions are not supported for suffix '*'", i)
+	}
+	if c.minBitrate < 0 || c.maxBitrate < 0 || c.minSampleRate < 0 || c.maxSampleRate < 0 {
+		log.Errorf("Rule #%d: Conditions must not be negative", i)
+		return nil, fmt.Errorf("Rule #%d: Conditions must not be negative", i)
+	}
+	switch c.fallback {
+	case "":
+		c.fallback = fallbackCopy
+	case fallbackCopy, fallbackSkip:
+	default:
+		log.Errorf("Rule #%d: '%s' is not a valid fallback", i, r.Fallback)
+		return nil, fmt.Errorf("Rule #%d: '%s' is not a valid fallback", i, r.Fallback)
+	}
+
+	return &c, nil
+}
+
+// String returns the representation of the conditions that is used for the
+// scope fingerprint
+func (c *cond) String() string {
+	return fmt.Sprintf("bitrate:%d-%d|sample_rate:%d-%d|fallback:%s", c.minBitrate, c.maxBitrate, c.minSampleRate, c.maxSampleRate, c.fallback)
+}
+
+// met returns true if the source file properties p fulfill the conditions
+func (c *cond) met(p *mfProbe) bool {
+	return (c.minBitrate == 0 || p.Bitrate >= c.minBitrate) &&
+		(c.maxBitrate == 0 || p.Bitrate <= c.maxBitrate) &&
+		(c.minSampleRate == 0 || p.SampleRate >= c.minSampleRate) &&
+		(c.maxSampleRate == 0 || p.SampleRate <= c.maxSampleRate)
+}
+
+// applyCond evaluates the conditions of the conversion rule cv for the source
+// file f. If the conditions are met (or if cv has no conditions), cv is
+// returned. Otherwise, the fallback is returned: In case of fallback copy, a
+// copy rule is returned. In case of fallback skip, nil and false is returned.
+// If the properties of f cannot be determined, cv is returned. The result is
+// cached for the current run
+func (cfg *Config) applyCond(cv *cvm, f string) (*cvm, bool) {
+	if cv.cond == nil {
+		return cv, true
+	}
+
+	k := condKey{cv: cv, path: f}
+	cfg.conds.mu.Lock()
+	res, ok := cfg.conds.res[k]
+	cfg.conds.mu.Unlock()
+	if !ok {
+		res.cv, res.ok = cfg.evalCond(cv, f)
+		cfg.conds.mu.Lock()
+		if cfg.conds.res == nil {
+			cfg.conds.res = make(map[condKey]condRes)
+		}
+		cfg.conds.res[k] = res
+		cfg.conds.mu.Unlock()
+	}
+	return res.cv, res.ok
+}
+
+// evalCond evaluates the conditions of the conversion rule cv for the source
+// file f (see applyCond)
+func (cfg *Config) evalCond(cv *cvm, f string) (*cvm, bool) {
+	srcFile, err := file.Stat(f)
+	if err != nil {
+		log.Errorf("applyCond: %v", err)
+		return cv, true
+	}
+	p, err := cfg.mf.probe(relPath(cfg.SrcDir.Path(), f), srcFile)
+	if err != nil {
+		log.Errorf("applyCond: Conditions cannot be evaluated for '%s': %v", f, err)
+		return cv, true
+	}
+	if cv.cond.met(p) {
+		return cv, true
+	}
+
+	log.Debugf("applyCond: Conditions not met for '%s', fallback '%s'", f, cv.cond.fallback)
+	if cv.cond.fallback == fallbackSkip {
+		return nil, false
+	}
+	return &cvm{SrcSuffix: cv.SrcSuffix, Path: cv.Path, TrgSuffix: suffixStar, NormCvStr: cvCopyStr}, true
+}
+
+// CondDesc returns a description of the conditions of the conversion rule for
+// display purposes. If the rule has no conditions, an empty string is returned
+func (cv *cvm) CondDesc() string {
+	if cv.cond == nil {
+		return ""
+	}
+
+	var a []string
+	if cv.cond.minBitrate > 0 {
+		a = append(a, fmt.Sprintf("bit rate >= %d kbps", cv.cond.minBitrate))
+	}
+	if cv.cond.maxBitrate > 0 {
+		a = append(a, fmt.Sprintf("bit rate <= %d kbps", cv.cond.maxBitrate))
+	}
+	if cv.cond.minSampleRate > 0 {
+		a = append(a, fmt.Sprintf("sample rate >= %d Hz", cv.cond.minSampleRate))
+	}
+	if cv.cond.maxSampleRate > 0 {
+		a = append(a, fmt.Sprintf("sample rate <= %d Hz", cv.cond.maxSampleRate))
+	}
+	return "if " + strings.Join(a, ", ") + ", otherwise " + cv.cond.fallback
+}
@@ -1,10 +1,12 @@
 package smsync
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -30,7 +32,7 @@ type (
 	// conversion interface
 	conversion interface {
 		// execute conversion
-		exec(string, string, string) error
+		exec(context.Context, string, string, string) error
 
 		// normalize the conversion string
 		normCvStr(string) (string, error)
@@ -54,7 +56,7 @@ var (
 	all2MP3  cvAll2MP3  // conversion of all types to MP3
 	all2OGG  cvAll2OGG  // conversion of all types to OGG
 	all2OPUS cvAll2OPUS // conversion of all types to OPUS
-	cp       cvCopy     // copy conversionn
+	cp       cvCopy     // copy conversion (the copy mode is set per target)
 
 	// validCvs maps conversion keys (i.e. pairs of source and target
 	// suffices) to the supported conversions
@@ -85,8 +87,28 @@ var (
 	}
 )
 
-// convert executes conversion for one file
-func convert(cfg *Config, srcFile file.Info) cvOutput {
+// suffixAliases maps alternative spellings of file suffixes to their
+// canonical suffix. Rules for a canonical suffix apply to its aliases as well
+var suffixAliases = map[string]string{
+	"aiff": "aif",
+	"mp4":  "m4a",
+	"oga":  "ogg",
+	"wave": "wav",
+}
+
+// normSuffix returns the canonical form of the file suffix s. I.e. s is
+// converted to lower case and aliases are replaced by their canonical suffix
+func normSuffix(s string) string {
+	s = strings.ToLower(s)
+	if c, ok := suffixAliases[s]; ok {
+		return c
+	}
+	return s
+}
+
+// convert executes conversion for one file. If ctx is cancelled, a running
+// conversion is aborted
+func convert(ctx context.Context, cfg *Config, srcFile file.Info) cvOutput {
 	var (
 		trgFile string
 		trgInfo file.Info
@@ -106,26 +128,48 @@ func convert(cfg *Config, srcFile file.Info) cvOutput {
 	// assemble output file
 	trgFile = assembleTrgFile(cfg, srcFile.Path())
 
-	// if error directory doesn't exist: create it
-	if err := file.MkdirAll(filepath.Dir(trgFile), os.ModeDir|0755); err != nil {
+	// if target directory doesn't exist: create it
+	if err := cfg.mkTrgDir(filepath.Dir(trgFile)); err != nil {
 		log.Errorf("convert: %v", err)
 		return cvOutput{trgFile: nil, dur: 0, err: err}
 	}
 
-	// set transformation function
+	// set transformation function. Copies are skipped if the target file
+	// already has the size and modification time of the source file (e.g.
+	// since it has been copied before without manifest entry)
 	if cvm.NormCvStr == cvCopyStr {
-		cv = cp
+		if cfg.upToDate(srcFile, trgFile) {
+			log.Infof("Target file '%s' is up to date: no copy necessary", trgFile)
+			trgInfo, err = file.Stat(trgFile)
+			return cvOutput{trgFile: trgInfo, dur: 0, err: err}
+		}
+		cv = cvCopy{mode: cfg.CopyMode}
 	} else {
 		// determine transformation function for srcSuffix -> trgSuffix
-		cv = validCvs[cvKey{srcSuffix: fp.Suffix(srcFile.Path()), trgSuffix: cvm.TrgSuffix}]
+		cv = validCvs[cvKey{srcSuffix: normSuffix(fp.Suffix(srcFile.Path())), trgSuffix: cvm.TrgSuffix}]
 	}
 
-	// execute conversion
+	// execute conversion. The result is written into a temporary file, that
+	// is renamed to the target file if the conversion was successful. Thus,
+	// an interrupted conversion doesn't leave an incomplete target file
 	start := time.Now()
-	err = cv.exec(srcFile.Path(), trgFile, cvm.NormCvStr)
+	tmpFile := tmpTrgFile(trgFile)
+	err = cv.exec(ctx, srcFile.Path(), tmpFile, cvm.NormCvStr)
 
+	if err == nil {
+		err = cfg.setTrgAttrs(srcFile, tmpFile)
+	}
+	if err == nil {
+		if err = os.Rename(tmpFile, trgFile); err != nil {
+			log.Errorf("convert: %v", err)
+		}
+	} else {
+		writeFFMPEGError(cfg, trgFile, err)
+	}
 	if err == nil {
 		trgInfo, err = file.Stat(trgFile)
+	} else if e := os.Remove(tmpFile); e != nil && !os.IsNotExist(e) {
+		log.Errorf("convert: %v", e)
 	}
 
 	// call transformation function and return result
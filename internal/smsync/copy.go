@@ -1,17 +1,54 @@
 package smsync
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strings"
 
+	log "github.com/sirupsen/logrus"
 	"gitlab.com/go-utilities/file"
 )
 
-// implementation of interface "conversion" for simple file copy
-type cvCopy struct{}
+// constants for the copy mode, i.e. how copy rules create target files
+const (
+	CopyModeCopy     = "copy"     // copy the content of the source file
+	CopyModeReflink  = "reflink"  // create a reflink (copy-on-write clone) of the source file
+	CopyModeHardlink = "hardlink" // create a hard link to the source file
+	CopyModeAuto     = "auto"     // use the cheapest method that is possible: reflink, hard link or copy
+)
+
+// implementation of interface "conversion" for simple file copy. mode is the
+// copy mode (empty is equivalent to copy)
+type cvCopy struct {
+	mode string
+}
+
+// exec executes simple file copy. Depending on the copy mode, a reflink or a
+// hard link is created instead. If that's not possible (e.g. since source and
+// target are located on different file systems), the file is copied
+func (cv cvCopy) exec(ctx context.Context, srcFile string, trgFile string, cvStr string) error {
+	// a copy cannot be interrupted. Thus, it's only checked if the
+	// processing has been cancelled before the copy is started
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if cv.mode == CopyModeReflink || cv.mode == CopyModeAuto {
+		err := reflink(srcFile, trgFile)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("cvCopy.exec: Reflink of '%s' not possible: %v", srcFile, err)
+	}
+	if cv.mode == CopyModeHardlink || cv.mode == CopyModeAuto {
+		err := os.Link(srcFile, trgFile)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("cvCopy.exec: Hard link to '%s' not possible: %v", srcFile, err)
+	}
 
-// exec executes simple file copy
-func (cvCopy) exec(srcFile string, trgFile string, cvStr string) error {
 	return file.Copy(srcFile, trgFile)
 }
 
@@ -27,3 +64,19 @@ func (cvCopy) normCvStr(s string) (string, error) {
 	}
 	return cvCopyStr, nil
 }
+
+// upToDate returns true if the existing target file trgFile has the same
+// size as the source file srcFile and if its modification time fits: If the
+// modification time of target files is configured, it must be equal to that.
+// Otherwise, the target file must not be older than the source file. In this
+// case, a copy isn't necessary
+func (cfg *Config) upToDate(srcFile file.Info, trgFile string) bool {
+	info, err := os.Stat(trgFile)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != srcFile.Size() {
+		return false
+	}
+	if t, ok := cfg.trgModTime(srcFile); ok {
+		return info.ModTime().Equal(t)
+	}
+	return !info.ModTime().Before(srcFile.ModTime())
+}
@@ -0,0 +1,32 @@
+package smsync
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink creates trgFile as reflink of srcFile. This requires a file system
+// that supports copy-on-write (e.g. Btrfs or XFS) and that source and target
+// file are located on the same file system. If the reflink cannot be created,
+// trgFile is removed
+func reflink(srcFile string, trgFile string) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	trg, err := os.OpenFile(trgFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(trg.Fd()), int(src.Fd()))
+	if e := trg.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(trgFile)
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package smsync
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// reflink is not supported on this operating system. Thus, an error is
+// returned and the file is copied instead (see cvCopy.exec)
+func reflink(srcFile string, trgFile string) error {
+	return fmt.Errorf("reflinks are not supported on %s", runtime.GOOS)
+}
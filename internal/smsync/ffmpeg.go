@@ -4,11 +4,16 @@ package smsync
 // esp. the call to ffmpeg
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"gitlab.com/go-utilities/file"
 	fp "gitlab.com/go-utilities/filepath"
@@ -16,9 +21,96 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// ffmpegWaitDelay is the time that is waited for the output of ffmpeg after
+// ffmpeg has been killed
+const ffmpegWaitDelay = time.Second
+
+// ffmpegError is returned by execFFMPEG if ffmpeg failed. It contains the
+// output of ffmpeg
+type ffmpegError struct {
+	err error  // error returned from exec
+	out []byte // combined stdout and stderr of ffmpeg
+}
+
+// Error implements the error interface
+func (e *ffmpegError) Error() string {
+	return fmt.Sprintf("Error during execution of FFMPEG: %v", e.err)
+}
+
+// probeInfo contains the properties of an audio file that are determined with
+// ffprobe
+type probeInfo struct {
+	bitrate    int               // bit rate in kbps
+	sampleRate int               // sample rate in Hz
+	tags       map[string]string // tags (normalized to template fields)
+}
+
+// execFFPROBE calls ffprobe to determine the bit rate and the sample rate of
+// the first audio stream of srcFile. If the bit rate of the stream is not
+// available (e.g. for some VBR files), the overall bit rate of the file is
+// taken. In addition, the tags of the file are determined. Depending on the
+// format, they are stored on file or on stream level
+func execFFPROBE(srcFile string) (*probeInfo, error) {
+	args := []string{"-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=bit_rate,sample_rate:stream_tags:format=bit_rate:format_tags",
+		"-of", "json",
+		srcFile}
+
+	log.Debugf("FFprobe command: ffprobe %s", strings.Join(args, " "))
+
+	out, err := exec.Command("ffprobe", args...).Output() // nolint
+	if err != nil {
+		log.Errorf("Executed FFPROBE for %s: %v", srcFile, err)
+		return nil, fmt.Errorf("Error during execution of FFPROBE: %v", err)
+	}
+
+	var res struct {
+		Streams []struct {
+			BitRate    string            `json:"bit_rate"`
+			SampleRate string            `json:"sample_rate"`
+			Tags       map[string]string `json:"tags"`
+		} `json:"streams"`
+		Format struct {
+			BitRate string            `json:"bit_rate"`
+			Tags    map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err = json.Unmarshal(out, &res); err != nil {
+		log.Errorf("execFFPROBE: %v", err)
+		return nil, fmt.Errorf("Output of FFPROBE cannot be interpreted: %v", err)
+	}
+	if len(res.Streams) == 0 {
+		return nil, fmt.Errorf("FFPROBE: '%s' has no audio stream", srcFile)
+	}
+
+	var info probeInfo
+	bitrate, err := strconv.Atoi(res.Streams[0].BitRate)
+	if err != nil {
+		if bitrate, err = strconv.Atoi(res.Format.BitRate); err != nil {
+			return nil, fmt.Errorf("FFPROBE: bit rate of '%s' cannot be determined", srcFile)
+		}
+	}
+	info.bitrate = bitrate / 1000
+	if info.sampleRate, err = strconv.Atoi(res.Streams[0].SampleRate); err != nil {
+		return nil, fmt.Errorf("FFPROBE: sample rate of '%s' cannot be determined", srcFile)
+	}
+	raw := make(map[string]string)
+	for k, v := range res.Format.Tags {
+		raw[k] = v
+	}
+	for k, v := range res.Streams[0].Tags {
+		raw[k] = v
+	}
+	info.tags = normTags(raw)
+
+	return &info, nil
+}
+
 // execFFMPEG calls ffmpeg to convert srcFile to trgFile using the
-// conversion-specific parameters *params
-func execFFMPEG(srcFile string, trgFile string, params *[]string) error {
+// conversion-specific parameters *params. If ctx is cancelled, ffmpeg is
+// killed
+func execFFMPEG(ctx context.Context, srcFile string, trgFile string, params *[]string) error {
 	var args []string // arguments for FFMPEG
 
 	// add input file
@@ -38,26 +130,45 @@ func execFFMPEG(srcFile string, trgFile string, params *[]string) error {
 
 	log.Debugf("FFmpeg command: ffmpeg %s", strings.Join(args, " "))
 
-	// execute FFMPEG command
-	if out, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil { // nolint
+	// execute FFMPEG command. If ffmpeg has been killed since ctx has been
+	// cancelled, it's not waited longer than ffmpegWaitDelay for its output
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.WaitDelay = ffmpegWaitDelay
+	if out, err := cmd.CombinedOutput(); err != nil { // nolint
+		// if processing has been cancelled, the failure of ffmpeg is no
+		// conversion error
+		if ctx.Err() != nil {
+			log.Infof("Executed FFMPEG for %s: cancelled", srcFile)
+			return ctx.Err()
+		}
 		log.Errorf("Executed FFMPEG for %s: %v", srcFile, err)
 		log.Errorf("FFmpeg command: ffmpeg %s", strings.Join(args, " "))
 
-		// if error directory doesn't exist: create it
-		if e := file.MkdirAll(filepath.Join(".", errDir), os.ModeDir|0755); e != nil {
-			log.Errorf("Error from MkdirAll('%s'): %v", errDir, e)
-		}
-
-		// assemble error file name
-		errFile := filepath.Join(errDir, filepath.Base(fp.PathTrunk(trgFile))) + ".log"
-		// write stdout into error file
-		if e := os.WriteFile(errFile, out, 0644); e != nil {
-			log.Errorf("Couldn't write FFMPEG error file '%s's: %v", errFile, e)
-		}
-
-		return fmt.Errorf("Error during execution of FFMPEG: %v", err)
+		return &ffmpegError{err: err, out: out}
 	}
 
 	// everything's fine
 	return nil
 }
+
+// writeFFMPEGError writes the output of ffmpeg into a file in the error
+// directory of the target directory, if err is an ffmpegError
+func writeFFMPEGError(cfg *Config, trgFile string, err error) {
+	var fe *ffmpegError
+	if !errors.As(err, &fe) {
+		return
+	}
+
+	// if error directory doesn't exist: create it
+	dir := filepath.Join(cfg.TrgDir.Path(), errDir)
+	if e := file.MkdirAll(dir, os.ModeDir|0755); e != nil {
+		log.Errorf("Error from MkdirAll('%s'): %v", dir, e)
+	}
+
+	// assemble error file name
+	errFile := filepath.Join(dir, filepath.Base(fp.PathTrunk(trgFile))) + ".log"
+	// write stdout into error file
+	if e := os.WriteFile(errFile, fe.out, 0644); e != nil {
+		log.Errorf("Couldn't write FFMPEG error file '%s's: %v", errFile, e)
+	}
+}
@@ -1,21 +1,51 @@
 package smsync
 
 import (
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-	"time"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"gitlab.com/go-utilities/file"
 	fp "gitlab.com/go-utilities/filepath"
-	"gitlab.com/go-utilities/reflect"
 )
 
 // errDir is the directory that stores error logs from conversion
 const errDir = "smsync.cv.errs"
 
-// assembleTrgFile creates the target file path from the source file path
+// tmpPrefix is the prefix of temporary target files. Conversions write into a
+// temporary file first, which is renamed to the target file after the
+// conversion was successful
+const tmpPrefix = ".smsync.tmp."
+
+// ItemKind is the kind of a work list item
+type ItemKind int
+
+// kinds of work list items
+const (
+	ItemConvert   ItemKind = iota // convert (or copy) a source file
+	ItemDelete                    // delete an obsolete target file
+	ItemMove                      // move a target file whose source file has been moved or renamed
+	ItemDeleteDir                 // delete the target directory of an excluded source directory
+	ItemLink                      // create a symbolic link in the target directory
+)
+
+// WorkItem is an entry of the work list that is assembled by GetSyncFiles
+type WorkItem struct {
+	Kind     ItemKind  // kind of item
+	SrcFile  file.Info // source file (only for conversions and moves)
+	TrgFile  string    // target file
+	FromFile string    // target file that is moved to TrgFile (only for moves)
+	CvStr    string    // normalized conversion string (only for conversions and moves)
+	LinkTo   string    // target of the symbolic link (only for links)
+}
+
+// assembleTrgFile creates the target file path from the source file path.
+// File and directory names are sanitized for the file system of the target
 func assembleTrgFile(cfg *Config, srcFile string) string {
 	var trgSuffix string
 
@@ -28,21 +58,30 @@ func assembleTrgFile(cfg *Config, srcFile string) string {
 
 	// if corresponding conversion rule is for '*' ...
 	if cvm.TrgSuffix == suffixStar {
-		// ... target suffix is same as source suffix
-		trgSuffix = fp.Suffix(srcFile)
+		// ... target suffix is the canonical form of the source suffix
+		trgSuffix = normSuffix(fp.Suffix(srcFile))
 	} else {
 		// ... otherwise take target suffix from conversion rule
 		trgSuffix = cvm.TrgSuffix
 	}
 
-	trgFile, err := fp.PathRelCopy(cfg.SrcDir.Path(),
-		fp.PathTrunk(srcFile)+"."+trgSuffix,
-		cfg.TrgDir.Path())
+	// per default, the target path mirrors the source path. If a target path
+	// template is configured, the target path is determined from the tags
+	// of the source file
+	trunk, err := filepath.Rel(cfg.SrcDir.Path(), fp.PathTrunk(srcFile))
 	if err != nil {
 		log.Errorf("Target path cannot be assembled: %v", err)
 		return ""
 	}
-	return trgFile
+	if cfg.trgTmpl != nil {
+		if t, ok := cfg.tmplTrunk(srcFile, cvm); ok {
+			trunk = t
+		} else {
+			log.Warningf("Target path of '%s' cannot be determined from tags: source path is used", srcFile)
+		}
+	}
+	trunk += cfg.renameSuffix(relPath(cfg.SrcDir.Path(), srcFile))
+	return filepath.Join(cfg.TrgDir.Path(), sanitizePath(cfg.TrgFS, trunk+"."+trgSuffix))
 }
 
 // CleanUp remove temporary files
@@ -52,97 +91,122 @@ func CleanUp(cfg *Config) {
 	log.Debug("Removed log files (at least tried to do that)")
 }
 
-// deleteObsoleteFiles deletes directories and files that are available in the
-// target directory tree but not in the source directory tree. It is called
-// for all source directories that have been changed since the last sync.
-// Typically, this is relevant if directories or files have been renamed or
-// deleted. In this case, the parent directory has been touched. That's used to
-// identify the relevant directories and files.
-func deleteObsoleteFiles(cfg *Config, srcDir file.Info) {
-	log.Debugf("smsync.deleteObsoleteFiles(%s): BEGIN", srcDir.Path())
-	defer log.Debugf("smsync.deleteObsoleteFiles(%s): END", srcDir.Path())
+// deleteObsoleteFile deletes the target file trgFile, whose source file
+// doesn't exist anymore. Target directories that are empty afterwards are not
+// deleted here, since a concurrent conversion could need them. This must be
+// done with deleteEmptyDirs
+func deleteObsoleteFile(cfg *Config, trgFile string) error {
+	log.Debugf("smsync.deleteObsoleteFile(%s): BEGIN", trgFile)
+	defer log.Debugf("smsync.deleteObsoleteFile(%s): END", trgFile)
+
+	if err := os.Remove(trgFile); err != nil && !os.IsNotExist(err) {
+		log.Errorf("deleteObsoleteFile: %v", err)
+		return err
+	}
 
-	var (
-		trgDir string
-		exists bool
-		err    error
-	)
+	return nil
+}
 
-	// assemble target directory path
-	trgDir, err = fp.PathRelCopy(cfg.SrcDir.Path(),
-		srcDir.Path(),
-		cfg.TrgDir.Path())
-	if err != nil {
-		log.Errorf("deleteObsoleteFiles: %v", err)
-		return
+// deleteEmptyDirs deletes the target directory dir and its parent directories
+// as long as they are empty. It must not be called while conversions are
+// running, since they might have just created dir
+func deleteEmptyDirs(cfg *Config, dir string) {
+	for ; len(dir) > len(cfg.TrgDir.Path()); dir = filepath.Dir(dir) {
+		empty, err := file.IsEmpty(dir)
+		if err != nil || !empty {
+			break
+		}
+		if err = os.Remove(dir); err != nil {
+			log.Errorf("deleteEmptyDirs: %v", err)
+			break
+		}
 	}
+}
 
-	// nothing to do if target directory doesn't exist
-	if exists, err = file.Exists(trgDir); err != nil {
-		log.Errorf("deleteObsoleteFiles: %v", err)
-		return
+// deleteExclDir deletes the target directory dir of an excluded source
+// directory with its entire content. Parent directories that are empty
+// afterwards must be deleted with deleteEmptyDirs
+func deleteExclDir(cfg *Config, dir string) error {
+	log.Debugf("smsync.deleteExclDir(%s): BEGIN", dir)
+	defer log.Debugf("smsync.deleteExclDir(%s): END", dir)
+
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorf("deleteExclDir: %v", err)
+		return err
 	}
-	if !exists {
-		return
+
+	return nil
+}
+
+// exclTrgDirs returns the existing target directories that correspond to the
+// excluded source directories srcDirs. Target directories that contain target
+// files of source files in scope are not returned. If a target path template
+// is configured, target directories don't correspond to source directories.
+// In this case, nothing is returned
+func exclTrgDirs(cfg *Config, srcDirs []string) (dirs []string) {
+	if cfg.trgTmpl != nil {
+		return nil
 	}
 
-	// read entries of target directory
-	trgEntrs, err := os.ReadDir(trgDir)
-	if err != nil {
-		log.Errorf("deleteObsoleteFiles: %v", err)
-		return
+	for _, srcDir := range srcDirs {
+		trgRel := sanitizePath(cfg.TrgFS, relPath(cfg.SrcDir.Path(), srcDir))
+		trgDir := filepath.Join(cfg.TrgDir.Path(), trgRel)
+		if info, err := os.Stat(trgDir); err != nil || !info.IsDir() {
+			continue
+		}
+		if cfg.mf.seenUnder(trgRel) {
+			log.Warningf("Target directory '%s' of excluded source directory is not deleted since it contains target files of other source files", trgRel)
+			continue
+		}
+		log.Infof("Target directory '%s' of excluded source directory will be deleted", trgRel)
+		dirs = append(dirs, trgDir)
 	}
+	sort.Strings(dirs)
 
-	// loop over all entries of target directory
-	for _, trgEntr := range trgEntrs {
-		if trgEntr.IsDir() {
-			// if entry is a directory ...
-			b, err := file.Exists(filepath.Join(srcDir.Path(), trgEntr.Name()))
-			if err != nil {
-				log.Errorf("deleteObsoleteFiles: %v", err)
-				return
-			}
-			// ... and the counterpart on source side doesn't exists: ...
-			if !b {
-				// ... delete entry
-				if err = os.RemoveAll(filepath.Join(trgDir, trgEntr.Name())); err != nil {
-					log.Errorf("deleteObsoleteFiles: %v", err)
-					return
-				}
-			}
-		} else {
-			// if entry is a file ...
+	return dirs
+}
 
-			// if entry is not regular: do nothing and continue loop
-			if !trgEntr.Type().IsRegular() {
-				continue
-			}
-			// exclude smsync files (smsync.log or smsync.yaml) from deletion logic
-			if strings.Contains(trgEntr.Name(), LogFile) || strings.Contains(trgEntr.Name(), cfgFile) {
-				continue
-			}
-			// check if counterpart file on source side exists
-			tr := fp.PathTrunk(trgEntr.Name())
-			fs, err := filepath.Glob(fp.EscapePattern(filepath.Join(srcDir.Path(), tr)) + ".*")
-			if err != nil {
-				log.Errorf("deleteObsoleteFiles: %v", err)
-				return
-			}
-			// if counterpart does not exist: delete entry
-			if fs == nil {
-				if err = os.Remove(filepath.Join(trgDir, trgEntr.Name())); err != nil {
-					log.Errorf("deleteObsoleteFiles: %v", err)
-				}
-			}
-		}
+// excludedDir returns true if the source directory srcDir is excluded per
+// configuration or per override file. The source directory itself is never
+// regarded as excluded
+func excludedDir(cfg *Config, srcDir file.Info) bool {
+	rel := relPath(cfg.SrcDir.Path(), srcDir.Path())
+	if rel == "." {
+		return false
 	}
+	if matchAny(cfg.Excludes, rel) {
+		return true
+	}
+	o := cfg.dirOvr(srcDir.Path())
+	return o.excl && o.err == nil
+}
+
+// moveTrgFile moves the target file fromFile to trgFile. This is done if the
+// corresponding source file has been moved or renamed. Target directories
+// that are empty afterwards must be deleted with deleteEmptyDirs
+func moveTrgFile(cfg *Config, fromFile, trgFile string) error {
+	log.Debugf("smsync.moveTrgFile(%s): BEGIN", fromFile)
+	defer log.Debugf("smsync.moveTrgFile(%s): END", fromFile)
+
+	if err := cfg.mkTrgDir(filepath.Dir(trgFile)); err != nil {
+		log.Errorf("moveTrgFile: %v", err)
+		return err
+	}
+	if err := os.Rename(fromFile, trgFile); err != nil {
+		log.Errorf("moveTrgFile: %v", err)
+		return err
+	}
+
+	return nil
 }
 
 // DeleteTrg deletes all entries of the target directory
-func deleteTrg(dir string) {
+func deleteTrg(cfg *Config) {
 	log.Debug("smsync.deleteTrg: BEGIN")
 	defer log.Debug("smsync.deleteTrg: END")
 
+	dir := cfg.TrgDir.Path()
+
 	// read entries of target directory
 	trgEntrs, err := os.ReadDir(dir)
 	if err != nil {
@@ -152,8 +216,8 @@ func deleteTrg(dir string) {
 
 	// loop over all entries of target directory
 	for _, trgEntr := range trgEntrs {
-		// don't delete smsync files (smsync.log or SMSYNC.yaml)
-		if !trgEntr.IsDir() && (strings.Contains(trgEntr.Name(), LogFile) || strings.Contains(trgEntr.Name(), cfgFile)) {
+		// don't delete smsync files (smsync.log, smsync.yaml etc.)
+		if !trgEntr.IsDir() && (isSmsyncFile(trgEntr.Name()) || filepath.Join(dir, trgEntr.Name()) == cfg.cfgPath) {
 			continue
 		}
 		// delete entry
@@ -164,160 +228,714 @@ func deleteTrg(dir string) {
 	}
 }
 
-// GetSyncFiles determines which files need to be synched.
-// Files are only relevant if they need to be converted. Directories are only
-// relevant if they already exist on target side and might contain obsolete
-// files.
-// Note, that the entire directory path of a file is created (if this path
-// doesn't exist yet) if this file is created on target side
-// Note, that it's important to keep the number of existence checks on target
-// side as small as possible because target devices aer often external devices
-// (USB etc.). Thus existence checks on target side are time consuming.
-// Therefore, because relevant directories lead to existence checks on target
-// side in deleteObsoleteFiles(), the number of relevant directories has to be
-// as small as possible.
-func GetSyncFiles(cfg *Config, init bool) (files *[]*file.Info) {
+// GetSyncFiles determines which files need to be synched and returns them as
+// work list. Source files are relevant if they need to be converted, target
+// files are relevant if they are obsolete and need to be deleted.
+// Whether a source file needs to be converted is determined based on the
+// manifest: If there's no manifest entry for the corresponding target file or
+// if size or modification time of the source file or the conversion rule
+// differ from the manifest entry, the file is relevant. Target files are
+// obsolete if their manifest entry refers to a source file that doesn't exist
+// anymore or - in case rules or exclusions have been changed since the last
+// sync - that is out of scope now.
+// If dryRun is true, neither the manifest nor the config file are updated.
+func GetSyncFiles(cfg *Config, init bool, dryRun bool) (wl *[]*WorkItem) {
 	log.Debug("smsync.GetSyncFiles: BEGIN")
 	defer log.Debug("smsync.GetSyncFiles: END")
 
+	// in case of a dry run, the manifest must not be changed on disk
+	cfg.mf.readOnly = dryRun
+
+	// remove temporary files that have been left over by a crashed run
+	if !dryRun {
+		removeTmpFiles(cfg)
+	}
+
+	var (
+		excl []string   // excluded source directories
+		mu   sync.Mutex // protects excl
+	)
+
 	// filter function needed as input for file.Find(). This function contains
 	// the filter logic for files and directories.
-	// Note, what propagation means in this context:
-	// - NoneFromSuper: Filter logic is applied to sub directories and files
-	// - ValidFromSuper: Downward files are relevant, downward directories
-	//                   are not relevant without applying filter logic
-	// - InvalidFromSuper: file.Find() will not descend into the
-	//                     corresponding directory. I.e. all downward content
-	//                     will be ignored
 	filter := func(srcFile file.Info, vp file.ValidPropagate) (bool, file.ValidPropagate) {
 		log.Debugf("smsync.GetSyncFiles.filter(%s): BEGIN", srcFile.Path())
 		defer log.Debugf("smsync.GetSyncFiles(%s): END", srcFile.Path())
 
-		// distinguish between directories and files
-		if srcFile.IsDir() {
-			log.Debug("Directory")
+		// directories are never relevant themselves. Files are only relevant
+		// if they are in scope. Excluded directories are collected to delete
+		// their target directories. Directories with an invalid override file
+		// are marked as unknown, since their files cannot be checked
+		ok, vpSub := inScope(cfg, srcFile)
+		if !ok && srcFile.IsDir() {
+			if excludedDir(cfg, srcFile) {
+				mu.Lock()
+				excl = append(excl, srcFile.Path())
+				mu.Unlock()
+			} else if cfg.dirOvr(srcFile.Path()).err != nil {
+				cfg.mf.markUnknown(relPath(cfg.SrcDir.Path(), srcFile.Path()))
+			}
+		}
+		if !ok || srcFile.IsDir() {
+			return false, vpSub
+		}
+		// Here, srcFile is a file (no directory) that is in scope. Its
+		// target file is claimed to detect collisions. Whether it needs to
+		// be converted is determined after the collisions have been
+		// resolved. For files, downward propagation of relevance makes no
+		// sense. Thus, in this branch, 'NoneFromSuper' is always returned
+		trgRel := relPath(cfg.TrgDir.Path(), assembleTrgFile(cfg, srcFile.Path()))
+		cfg.mf.claim(collKey(cfg.TrgFS, trgRel), relPath(cfg.SrcDir.Path(), srcFile.Path()))
+		return true, file.NoneFromSuper
+	}
+
+	// traverse the source tree with the smsync filter function to get the
+	// files that are in scope
+	files, links := cfg.findSrc(filter)
+
+	// determine if the scope (i.e. rules, exclusions and override files) has
+	// been changed since the last sync. The override files are known only
+	// after the traversal
+	cfg.scope = cfg.fingerprint()
+	if !cfg.LastSync.IsZero() && cfg.lastScope != cfg.scope {
+		log.Info("Rules, exclusions or override files have been changed since the last sync")
+		cfg.ScopeChg = true
+	}
+
+	// resolve collisions of source files that are mapped to the same target
+	// file. Afterwards, only the source files that keep their target file or
+	// that got a disambiguating suffix are checked (with their final target
+	// file). Thus, a source file that is skipped due to a collision never
+	// takes over a target file in the manifest
+	skip := resolveCollisions(cfg, cfg.mf.claims())
+
+	// assemble work list
+	var cvs []*WorkItem
+	for _, f := range files {
+		if skip[relPath(cfg.SrcDir.Path(), f.Path())] {
+			continue
+		}
+		if cv, _ := cfg.getCv(f.Path()); srcChgd(cfg, f, cv, init) {
+			cvs = append(cvs, cvItem(cfg, f))
+		}
+	}
+	// symbolic links that need to be created in the target directory (mode
+	// copy-link)
+	var lnks []*WorkItem
+	for _, l := range links {
+		if item, _ := linkItem(cfg, l, init); item != nil {
+			lnks = append(lnks, item)
+		}
+	}
+	cfg.mf.dropProbes()
+	obs := cfg.mf.obsolete(cfg.ScopeChg && !init, func(srcRel string) bool { return srcInScope(cfg, srcRel) })
+
+	// files that have been moved or renamed on source side don't need to be
+	// converted again. Their target files are moved instead. Deletions are at
+	// the head of the work list, so that the space they free is available for
+	// the conversions
+	wl = new([]*WorkItem)
+	dirs := exclTrgDirs(cfg, excl)
+	mvs, cvs, obs := detectMoves(cfg, cvs, obs)
+	mvs, cvs, obs = dropMovesFrom(cfg, dirs, mvs, cvs, obs)
+	for _, trgRel := range obs {
+		*wl = append(*wl, &WorkItem{
+			Kind:    ItemDelete,
+			TrgFile: filepath.Join(cfg.TrgDir.Path(), trgRel),
+		})
+	}
+	for _, dir := range dirs {
+		*wl = append(*wl, &WorkItem{
+			Kind:    ItemDeleteDir,
+			TrgFile: dir,
+		})
+	}
+	*wl = append(*wl, mvs...)
+	*wl = append(*wl, orderCvs(cfg, cvs)...)
+	*wl = append(*wl, lnks...)
+
+	if dryRun {
+		return wl
+	}
+
+	// save manifest if existing target files have been taken over or if
+	// properties of source files have been determined
+	if cfg.mf.updates > 0 {
+		cfg.mf.write()
+	}
+
+	// if the scope has been changed but nothing needs to be synchronized, the
+	// new scope is stored right away
+	if cfg.ScopeChg && len(*wl) == 0 {
+		cfg.setScope()
+	}
+
+	return wl
+}
+
+// cvItem creates a work list item for the conversion of the source file f
+func cvItem(cfg *Config, f file.Info) *WorkItem {
+	cv, _ := cfg.getCv(f.Path())
+	return &WorkItem{
+		Kind:    ItemConvert,
+		SrcFile: f,
+		TrgFile: assembleTrgFile(cfg, f.Path()),
+		CvStr:   cv.NormCvStr,
+	}
+}
+
+// detectMoves identifies source files that have been moved or renamed since
+// the last sync. These files appear as new files in the list of conversions
+// cvs, while the manifest entries of their target files are contained in the
+// list of obsolete target files obs. A new file and an obsolete target file
+// belong together if the conversion rule is the same and size and
+// modification time (or - in change detection mode hash - the content hash)
+// of the source files are equal. If several obsolete target files fit to a
+// new file, see pickMove. For each pair, a move item is created. The
+// remaining conversions and obsolete target files are returned as well
+func detectMoves(cfg *Config, cvs []*WorkItem, obs []string) (mvs []*WorkItem, cvsRest []*WorkItem, obsRest []string) {
+	var (
+		cands  = make(map[string][]string) // obsolete target files per key
+		hashes = make(map[string]bool)     // keys that are based on content hashes
+		sizes  = make(map[int64]bool)      // source sizes of obsolete target files
+		used   = make(map[string]bool)     // obsolete target files that are moved
+		news   []string                    // target files of new source files
+	)
+
+	// local function to assemble the key that's used to identify moved files
+	key := func(size int64, s, rule string) string {
+		return fmt.Sprintf("%d|%s|%s", size, s, rule)
+	}
 
-			// if a directory is excluded, itself and all sub directories and
-			// files are not relevant
-			if reflect.Contains(cfg.Excludes, srcFile.Path()) {
-				return false, file.InvalidFromSuper
+	for _, trgRel := range obs {
+		e, ok := cfg.mf.get(trgRel)
+		if !ok {
+			continue
+		}
+		if cfg.ChgDetect == ChgDetectHash && e.SrcHash != "" {
+			k := key(e.SrcSize, e.SrcHash, e.Rule)
+			cands[k] = append(cands[k], trgRel)
+			hashes[k] = true
+		}
+		k := key(e.SrcSize, e.SrcModTime, e.Rule)
+		cands[k] = append(cands[k], trgRel)
+		sizes[e.SrcSize] = true
+	}
+
+	for _, item := range cvs {
+		trgRel := relPath(cfg.TrgDir.Path(), item.TrgFile)
+		if _, ok := cfg.mf.get(trgRel); !ok {
+			news = append(news, trgRel)
+		}
+	}
+	newPos, oldPos := dirPos(news), dirPos(obs)
+
+	for _, item := range cvs {
+		trgRel := relPath(cfg.TrgDir.Path(), item.TrgFile)
+
+		// only new files (i.e. files without manifest entry) and files
+		// with a size of an obsolete target file are relevant
+		if _, ok := cfg.mf.get(trgRel); ok || !sizes[item.SrcFile.Size()] {
+			cvsRest = append(cvsRest, item)
+			continue
+		}
+
+		cv, _ := cfg.getCv(item.SrcFile.Path())
+		keys := []string{key(item.SrcFile.Size(), mfModTime(item.SrcFile.ModTime()), cv.String())}
+		if cfg.ChgDetect == ChgDetectHash {
+			hash, err := cfg.mf.srcHash(relPath(cfg.SrcDir.Path(), item.SrcFile.Path()), item.SrcFile)
+			if err == nil {
+				keys = append([]string{key(item.SrcFile.Size(), hash, cv.String())}, keys...)
 			}
-			// if relevance is propagated from the parent, this directory is not
-			// relevant, but all sub directories and files are relevant
-			if vp == file.ValidFromSuper {
-				log.Debug("VALID FROM SUPER -> FALSE, VALID FROM SUPER")
+		}
 
-				return false, file.ValidFromSuper
+		// candidates are the unused obsolete target files of the first key
+		// that has any. Candidates with the same content hash are
+		// interchangeable, otherwise the choice must be unambiguous
+		var (
+			from string
+			ok   bool
+		)
+		for _, k := range keys {
+			var free []string
+			for _, c := range cands[k] {
+				if !used[c] {
+					free = append(free, c)
+				}
 			}
-			// if the target side shall be initialized, this directory is not
-			// relevant but relevance is propagated downwards
-			if init {
-				log.Debug("init -> FALSE, VALID FROM SUPER")
-				return false, file.ValidFromSuper
+			if len(free) == 0 {
+				continue
 			}
-			// if the directory has been changed since the last sync, it's
-			// relevant. This is because, it could be an indicator, that either
-			// sub directories or files in that directory have been renamed.
-			// Relevance is not propagated since the filter logic needs to be
-			// applied to them
-			if srcFile.ModTime().After(cfg.LastSync) && !cfg.LastSync.IsZero() {
-				log.Debug("Modtime > lastsync -> TRUE, NONE FROM SUPER")
-				return true, file.NoneFromSuper
+			if hashes[k] {
+				from, ok = free[0], true
+			} else {
+				from, ok = pickMove(trgRel, free, newPos, oldPos)
 			}
-			// if parent has been changed ...
-			if parentDirChgd(filepath.Dir(srcFile.Path()), cfg.LastSync) {
-				// ... it could be that this directory has been renamed. Thus,
-				// it needs to be checked if it's counterpart exists on target
-				// side. If that's the case, this directory is not relevant but
-				// downwards content needs to be filtered. Otherwise, it's
-				// clear that the downward content is relevant, filter logic
-				// doesn't have to be applied.
-				log.Debug("Parent dir changed")
-
-				// assemble target directory
-				trgDir, _ := fp.PathRelCopy(cfg.SrcDir.Path(), srcFile.Path(), cfg.TrgDir.Path())
-				// check if target directory exists
-				if exists, err := file.Exists(trgDir); err == nil && !exists {
-					log.Debug("Trg doesn't exist -> FALSE, NONE FROM SUPER")
-
-					return false, file.ValidFromSuper
-				}
+			break
+		}
+		if !ok {
+			cvsRest = append(cvsRest, item)
+			continue
+		}
+
+		used[from] = true
+		item.Kind = ItemMove
+		item.FromFile = filepath.Join(cfg.TrgDir.Path(), from)
+		mvs = append(mvs, item)
+		log.Infof("'%s' has been moved to '%s'", from, trgRel)
+	}
+
+	for _, trgRel := range obs {
+		if !used[trgRel] {
+			obsRest = append(obsRest, trgRel)
+		}
+	}
+
+	return mvs, cvsRest, obsRest
+}
+
+// pickMove chooses the obsolete target file that has been moved to trgRel
+// from the candidates cands. A single candidate is taken. Among several
+// candidates, the one with the same base name is preferred, then the one with
+// the same position in its directory (newPos and oldPos, see dirPos). If the
+// choice is still ambiguous, false is returned: the file is converted then,
+// since a wrong move would result in wrong content under the target name
+func pickMove(trgRel string, cands []string, newPos, oldPos map[string]dirIdx) (string, bool) {
+	if len(cands) == 1 {
+		return cands[0], true
+	}
+
+	var same []string
+	for _, c := range cands {
+		if filepath.Base(c) == filepath.Base(trgRel) {
+			same = append(same, c)
+		}
+	}
+	switch len(same) {
+	case 0:
+		same = cands
+	case 1:
+		return same[0], true
+	}
+
+	// positions can only be compared if both directories contain the same
+	// number of files
+	var pos []string
+	for _, c := range same {
+		if oldPos[c] == newPos[trgRel] {
+			pos = append(pos, c)
+		}
+	}
+	if len(pos) == 1 {
+		return pos[0], true
+	}
+
+	log.Infof("'%s' might have been moved from one of %s: it's converted since the choice is ambiguous", trgRel, strings.Join(cands, ", "))
+	return "", false
+}
+
+// dirIdx is the position of a file in its directory
+type dirIdx struct {
+	idx int // index of the file (in lexical order)
+	num int // number of files in the directory
+}
+
+// dirPos determines the position of each of the files rels in its directory,
+// taking only the files of rels into account
+func dirPos(rels []string) map[string]dirIdx {
+	var (
+		dirs = make(map[string][]string)
+		pos  = make(map[string]dirIdx)
+	)
+	for _, rel := range rels {
+		dirs[filepath.Dir(rel)] = append(dirs[filepath.Dir(rel)], rel)
+	}
+	for _, fs := range dirs {
+		sort.Strings(fs)
+		for i, rel := range fs {
+			pos[rel] = dirIdx{idx: i, num: len(fs)}
+		}
+	}
+	return pos
+}
+
+// dropMovesFrom turns the moves mvs whose target file is located in one of
+// the target directories dirs (that will be deleted) back into conversions.
+// The target files that would have been moved are added to the obsolete
+// target files obs
+func dropMovesFrom(cfg *Config, dirs []string, mvs []*WorkItem, cvs []*WorkItem, obs []string) (mvsRest []*WorkItem, cvsAll []*WorkItem, obsAll []string) {
+	cvsAll, obsAll = cvs, obs
+	for _, item := range mvs {
+		in := false
+		for _, dir := range dirs {
+			if strings.HasPrefix(item.FromFile, dir+string(filepath.Separator)) {
+				in = true
+				break
 			}
-			// if none of the above rules applied, this directory is not
-			// relevant and the downward content needs to be filtered
-			log.Debug("Nothing applied -> FALSE, NONE FROM SUPER")
-			return false, file.NoneFromSuper
-		}
-		// Here, srcFile is a file (no directory). For files, downward
-		// propagation of relevance makes no sense. Thus, in this branch,
-		// 'NoneFromSuper' is always returned
-		log.Debug("File")
-
-		// if file is not regular, it's not relevant
-		if !srcFile.Mode().IsRegular() {
-			return false, file.NoneFromSuper
-		}
-		// if file type is not relevant per the smsync configuration, this file
-		// is not relevant
-		if _, ok := cfg.getCv(srcFile.Path()); !ok {
-			return false, file.NoneFromSuper
-		}
-		// if relevance is propagated from the parent, this file is relevant
-		// without further checks
-		if vp == file.ValidFromSuper {
-			log.Debug("VALID FROM SUPER -> TRUE, VALID FROM SUPER")
-
-			return true, file.NoneFromSuper
-		}
-		// assemble target file name and check if file exists
-		trgFile := assembleTrgFile(cfg, srcFile.Path())
-		exists, inf, err := file.ExistsInfo(trgFile)
-		// if this file has been changed since last sync and if the counterpart
-		// on target side does either not exist or exists but is older than the
-		// last sync time, then this file is relevant.
-		// Note, that if the last run has been interrupted, it could be that the
-		// counterpart on target side has already been updated before the
-		// interrupt (and thus its mod time is after the last sync). In this
-		// case this file is not relevant.
-		if srcFile.ModTime().After(cfg.LastSync) {
-			log.Debug("Modtime > lastsync")
-
-			if err == nil && (!exists || inf.ModTime().Before(cfg.LastSync) && !cfg.LastSync.IsZero()) {
-				log.Debug("Trg doesn't exist or modtime < lastsync or lastsync==0 -> TRUE, NONE FROM SUPER")
-
-				return true, file.NoneFromSuper
+		}
+		if !in {
+			mvsRest = append(mvsRest, item)
+			continue
+		}
+		obsAll = append(obsAll, relPath(cfg.TrgDir.Path(), item.FromFile))
+		item.Kind, item.FromFile = ItemConvert, ""
+		cvsAll = append(cvsAll, item)
+	}
+	return mvsRest, cvsAll, obsAll
+}
+
+// ObsoleteDirs returns the target directories that will be deleted because
+// they are empty after the obsolete files of the work list wl have been
+// deleted. Only the top-most of these directories are returned
+func ObsoleteDirs(cfg *Config, wl *[]*WorkItem) (dirs []string) {
+	var (
+		del     = make(map[string]bool) // target files that will be deleted
+		cands   = make(map[string]bool) // directories that might become empty
+		keep    = make(map[string]bool) // directories that will get new files
+		memo    = make(map[string]bool) // directories that will be empty
+		emptied func(string) bool
+	)
+
+	for _, item := range *wl {
+		// files and directories that are deleted or moved away
+		var gone string
+		switch item.Kind {
+		case ItemDelete, ItemDeleteDir:
+			gone = item.TrgFile
+		case ItemMove:
+			gone = item.FromFile
+		}
+		if gone != "" {
+			del[gone] = true
+			for dir := filepath.Dir(gone); len(dir) > len(cfg.TrgDir.Path()); dir = filepath.Dir(dir) {
+				cands[dir] = true
+			}
+		}
+		// files that are created
+		if item.Kind != ItemDelete && item.Kind != ItemDeleteDir {
+			for dir := filepath.Dir(item.TrgFile); len(dir) > len(cfg.TrgDir.Path()); dir = filepath.Dir(dir) {
+				keep[dir] = true
 			}
-			log.Debug("Trg exist and (modtime > lastsync or lastsync!=0) -> FALSE, NONE FROM SUPER")
-			return false, file.NoneFromSuper
-		}
-		// if parent was changed it could be that this files was renamed. Thus, it
-		// needs to be checked if it's counterpart exists on target side. If the
-		// counterpart exists, then this file is not relevant. Otherwise it is
-		// relevant.
-		if parentDirChgd(filepath.Dir(srcFile.Path()), cfg.LastSync) && err == nil && !exists {
-			log.Debug("Parent dir changed and trg doesn't exist -> TRUE, NONE FROM SUPER")
-			return true, file.NoneFromSuper
-		}
-		log.Debug("Nothing applied -> FALSE, NONE FROM SUPER")
+		}
+	}
+
+	// emptied checks if dir will be empty after the deletion of the obsolete
+	// files
+	emptied = func(dir string) bool {
+		if b, ok := memo[dir]; ok {
+			return b
+		}
+		// directories of excluded source directories are deleted entirely
+		if del[dir] {
+			return true
+		}
+		b := cands[dir] && !keep[dir]
+		if b {
+			entrs, err := os.ReadDir(dir)
+			if err != nil {
+				log.Errorf("ObsoleteDirs: %v", err)
+				b = false
+			}
+			for _, entr := range entrs {
+				path := filepath.Join(dir, entr.Name())
+				if (entr.IsDir() && !emptied(path)) || (!entr.IsDir() && !del[path]) {
+					b = false
+					break
+				}
+			}
+		}
+		memo[dir] = b
+		return b
+	}
+
+	for dir := range cands {
+		if !del[dir] && emptied(dir) && !emptied(filepath.Dir(dir)) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// inScope determines whether srcFile is in the scope of the smsync
+// configuration. Directories are in scope if they are not excluded. Files are
+// in scope if they are regular, not excluded, included (if inclusions are
+// configured) and a conversion rule exists for them. The
+// second return value tells file.Find() whether it shall descend into a
+// directory:
+//   - NoneFromSuper: Filter logic is applied to sub directories and files
+//   - InvalidFromSuper: file.Find() will not descend into the corresponding
+//     directory. I.e. all downward content will be ignored
+func inScope(cfg *Config, srcFile file.Info) (bool, file.ValidPropagate) {
+	rel := relPath(cfg.SrcDir.Path(), srcFile.Path())
+
+	if srcFile.IsDir() {
+		// if a directory is excluded, itself and all sub directories and
+		// files are not relevant. The source directory itself can't be
+		// excluded
+		if rel != "." && matchAny(cfg.Excludes, rel) {
+			return false, file.InvalidFromSuper
+		}
+		// the same applies if the directory is excluded per override file or
+		// if an override file is invalid
+		if o := cfg.dirOvr(srcFile.Path()); o.excl || o.err != nil {
+			return false, file.InvalidFromSuper
+		}
+		return true, file.NoneFromSuper
+	}
+	// if file is not regular or an override file, it's not relevant
+	if !srcFile.Mode().IsRegular() || srcFile.Name() == ovrFile {
 		return false, file.NoneFromSuper
 	}
+	// if file is excluded or not included, it's not relevant
+	if matchAny(cfg.Excludes, rel) || !included(cfg, rel) {
+		return false, file.NoneFromSuper
+	}
+	// if file type is not relevant per the smsync configuration, this file
+	// is not relevant
+	_, ok := cfg.getCv(srcFile.Path())
+	return ok, file.NoneFromSuper
+}
 
-	// call FindFiles with the smsync filter function to get the directories and files
-	files = file.Find([]file.Info{cfg.SrcDir}, filter, 1)
+// srcInScope determines whether the source file srcRel (relative to the
+// source directory) exists and is in scope. Contrary to inScope, the parent
+// directories are checked as well. If that's not possible since the file
+// cannot be accessed or an override file is invalid, true is returned to be
+// on the safe side
+func srcInScope(cfg *Config, srcRel string) bool {
+	srcFile, err := file.Stat(filepath.Join(cfg.SrcDir.Path(), srcRel))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
+		log.Errorf("srcInScope: %v", err)
+		return true
+	}
 
-	return files
+	// symbolic links are only in scope if they are followed or copied.
+	// Linked directories are only traversed if they are followed
+	if cfg.Symlinks != SymlinksFollow {
+		if self, parent := linkedPath(cfg, srcRel); parent || (self && cfg.Symlinks == SymlinksSkip) {
+			return false
+		}
+	}
+
+	// check parent directories
+	for dir := filepath.Dir(srcRel); dir != "."; dir = filepath.Dir(dir) {
+		if matchAny(cfg.Excludes, dir) {
+			return false
+		}
+	}
+	if o := cfg.dirOvr(filepath.Dir(srcFile.Path())); o.err != nil {
+		return true
+	} else if o.excl {
+		return false
+	}
+
+	ok, _ := inScope(cfg, srcFile)
+	return ok
+}
+
+// included returns true if the path rel (relative to the source directory)
+// belongs to one of the sub trees that are included per the configuration. If
+// no inclusions are configured, the entire source directory is included
+func included(cfg *Config, rel string) bool {
+	if len(cfg.Includes) == 0 {
+		return true
+	}
+	for _, p := range cfg.Includes {
+		if matchTree(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// expTrgFiles traverses the source directory tree and determines the target
+// file for every source file that is in scope. It returns a map of target
+// file paths (relative to the target directory) to source files. With that
+// map, every target file can be mapped back to its expected source file
+func expTrgFiles(cfg *Config) map[string]file.Info {
+	log.Debug("smsync.expTrgFiles: BEGIN")
+	defer log.Debug("smsync.expTrgFiles: END")
+
+	filter := func(srcFile file.Info, vp file.ValidPropagate) (bool, file.ValidPropagate) {
+		ok, vpSub := inScope(cfg, srcFile)
+		return ok && !srcFile.IsDir(), vpSub
+	}
+
+	files, links := cfg.findSrc(filter)
+	var (
+		keys = make(map[string][]string) // source files per collision key of target file
+		trgs = make(map[string]string)   // target file per source file
+	)
+	for _, f := range files {
+		srcRel := relPath(cfg.SrcDir.Path(), f.Path())
+		trgs[srcRel] = relPath(cfg.TrgDir.Path(), assembleTrgFile(cfg, f.Path()))
+		k := collKey(cfg.TrgFS, trgs[srcRel])
+		keys[k] = append(keys[k], srcRel)
+	}
+
+	// collisions are resolved in the same way as during synchronization
+	skip := resolveCollisions(cfg, keys)
+
+	exp := make(map[string]file.Info)
+	for _, f := range files {
+		srcRel := relPath(cfg.SrcDir.Path(), f.Path())
+		if skip[srcRel] {
+			continue
+		}
+		if cfg.renames[srcRel] > 0 {
+			trgs[srcRel] = relPath(cfg.TrgDir.Path(), assembleTrgFile(cfg, f.Path()))
+		}
+		exp[trgs[srcRel]] = f
+	}
+	for _, l := range links {
+		if trgFile, _, err := linkTrg(cfg, l); err == nil {
+			exp[relPath(cfg.TrgDir.Path(), trgFile)] = l
+		}
+	}
+	return exp
+}
+
+// isSmsyncFile returns true if name is the name of one of the files that
+// smsync stores in the target directory (config, log, manifest)
+func isSmsyncFile(name string) bool {
+	return strings.Contains(name, LogFile) ||
+		strings.Contains(name, cfgFile) ||
+		strings.Contains(name, mfFile)
+}
+
+// tmpTrgFile returns the path of the temporary file for the target file
+// trgFile. The temporary file is located in the same directory as trgFile (so
+// that it can be renamed atomically) and keeps the suffix of trgFile (since
+// ffmpeg derives the output format from it)
+func tmpTrgFile(trgFile string) string {
+	return filepath.Join(filepath.Dir(trgFile), tmpPrefix+filepath.Base(trgFile))
+}
+
+// removeTmpFiles removes the temporary files that have been left over by a
+// crashed run. The target tree is traversed once, since the temporary files of
+// target files whose source files have been deleted or renamed in the
+// meantime must be removed as well
+func removeTmpFiles(cfg *Config) {
+	log.Debug("smsync.removeTmpFiles: BEGIN")
+	defer log.Debug("smsync.removeTmpFiles: END")
+
+	err := filepath.WalkDir(cfg.TrgDir.Path(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Errorf("removeTmpFiles: %v", err)
+			return nil
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), tmpPrefix) {
+			return nil
+		}
+		log.Infof("Remove temporary file '%s'", path)
+		if err := os.Remove(path); err != nil {
+			log.Errorf("removeTmpFiles: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("removeTmpFiles: %v", err)
+	}
 }
 
-// parentDirChgd returns true if the file speicified by path has changed after
-// time t
-func parentDirChgd(path string, t time.Time) bool {
-	fi, err := os.Stat(path)
+// relPath returns path relative to base. In case of an error, path is
+// returned unchanged
+func relPath(base, path string) string {
+	rel, err := filepath.Rel(base, path)
 	if err != nil {
-		log.Errorf("parentDirChgd: %v", err)
+		log.Errorf("relPath: %v", err)
+		return path
+	}
+	return rel
+}
+
+// srcChgd determines whether the source file srcFile needs to be converted
+// with the conversion rule cv
+func srcChgd(cfg *Config, srcFile file.Info, cv *cvm, init bool) bool {
+	trgFile := assembleTrgFile(cfg, srcFile.Path())
+	trgRel := relPath(cfg.TrgDir.Path(), trgFile)
+	srcRel := relPath(cfg.SrcDir.Path(), srcFile.Path())
+
+	// mark target and source file as found. This is needed to identify
+	// obsolete target files later on
+	cfg.mf.see(trgRel, srcRel)
+
+	// in case of an initial sync, all files are relevant
+	if init {
+		return true
+	}
+	// if there's a manifest entry for the target file, the source file is
+	// relevant if it or the conversion rule have been changed since the
+	// target file has been created
+	if e, ok := cfg.mf.get(trgRel); ok {
+		if e.SrcFile != srcRel || e.Rule != cv.String() {
+			return true
+		}
+		return srcModified(cfg, e, trgRel, srcFile)
+	}
+	// without manifest entry, the file is relevant if it's new or has been
+	// changed since the last sync
+	if cfg.LastSync.IsZero() || srcFile.ModTime().After(cfg.LastSync) {
+		return true
+	}
+	// here, the file hasn't been changed since the last sync, but the
+	// manifest doesn't know it. This happens if the target has been
+	// synchronized by a smsync version without manifest or if files have been
+	// imported with old timestamps. If the target file exists, it's taken
+	// over into the manifest, otherwise the file is relevant
+	exists, trgInfo, err := file.ExistsInfo(trgFile)
+	if err != nil || !exists {
+		return true
+	}
+	var hash string
+	if cfg.ChgDetect == ChgDetectHash {
+		if hash, err = cfg.mf.srcHash(srcRel, srcFile); err != nil {
+			return true
+		}
+	}
+	cfg.mf.set(trgRel, newMfEntry(srcRel, srcFile, hash, trgInfo, cv))
+	return false
+}
+
+// srcModified determines whether the content of the source file srcFile
+// differs from what is recorded in the manifest entry e of the target file
+// trgRel. Per default, size and modification time are compared. In change
+// detection mode hash, the content hash is compared instead. The hash is only
+// calculated if size or modification time differ from the manifest entry. If
+// only the modification time has changed but not the content, the manifest
+// entry is updated
+func srcModified(cfg *Config, e *mfEntry, trgRel string, srcFile file.Info) bool {
+	sameStat := e.SrcSize == srcFile.Size() && e.SrcModTime == mfModTime(srcFile.ModTime())
+
+	if cfg.ChgDetect != ChgDetectHash {
+		return !sameStat
+	}
+	if e.SrcSize != srcFile.Size() {
+		return true
+	}
+	if sameStat && e.SrcHash != "" {
 		return false
 	}
-	if fi.IsDir() && fi.ModTime().After(t) {
+
+	hash, err := cfg.mf.srcHash(e.SrcFile, srcFile)
+	if err != nil {
 		return true
 	}
+	// if no hash is recorded yet (since the entry has been created in change
+	// detection mode mtime), the file is only unchanged if the modification
+	// time is unchanged
+	if hash != e.SrcHash && (e.SrcHash != "" || !sameStat) {
+		return true
+	}
+
+	// content is unchanged: update manifest entry with current modification
+	// time and hash
+	u := *e
+	u.SrcModTime = mfModTime(srcFile.ModTime())
+	u.SrcHash = hash
+	cfg.mf.set(trgRel, &u)
 	return false
 }
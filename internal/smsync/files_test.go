@@ -0,0 +1,135 @@
+package smsync
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gitlab.com/go-utilities/file"
+)
+
+// testCfg creates a configuration with empty source and target directories
+// and a single rule that converts flac into mp3
+func testCfg(t *testing.T) *Config {
+	t.Helper()
+
+	var (
+		cfg = new(Config)
+		dir = t.TempDir()
+		err error
+	)
+	for _, d := range []string{"src", "trg"} {
+		if err = os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg.SrcDir, err = file.Stat(filepath.Join(dir, "src")); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TrgDir, err = file.Stat(filepath.Join(dir, "trg")); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ChgDetect = ChgDetectMTime
+	cfg.TrgFS = TrgFSPosix
+	cfg.Cvs = []*cvm{{SrcSuffix: "flac", TrgSuffix: "mp3", NormCvStr: "vbr:5|cl:3"}}
+	cfg.ovrs = newOvrs()
+	cfg.mf = newMf(cfg.TrgDir.Path())
+	return cfg
+}
+
+func TestDetectMoves(t *testing.T) {
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		obs  []string          // obsolete target files (relative)
+		news map[string]string // new source files and their target files (relative)
+		mvs  map[string]string // expected moves: new target file -> obsolete target file
+	}{
+		{
+			name: "single candidate",
+			obs:  []string{"A/x.mp3"},
+			news: map[string]string{"B/z.flac": "B/z.mp3"},
+			mvs:  map[string]string{"B/z.mp3": "A/x.mp3"},
+		},
+		{
+			name: "album renamed",
+			obs:  []string{"A/1.mp3", "A/2.mp3", "A/3.mp3"},
+			news: map[string]string{"B/1.flac": "B/1.mp3", "B/2.flac": "B/2.mp3", "B/3.flac": "B/3.mp3"},
+			mvs:  map[string]string{"B/1.mp3": "A/1.mp3", "B/2.mp3": "A/2.mp3", "B/3.mp3": "A/3.mp3"},
+		},
+		{
+			name: "tracks renamed",
+			obs:  []string{"A/01.mp3", "A/02.mp3"},
+			news: map[string]string{"A/1 intro.flac": "A/1 intro.mp3", "A/2 song.flac": "A/2 song.mp3"},
+			mvs:  map[string]string{"A/1 intro.mp3": "A/01.mp3", "A/2 song.mp3": "A/02.mp3"},
+		},
+		{
+			name: "ambiguous",
+			obs:  []string{"A/x.mp3", "A/y.mp3"},
+			news: map[string]string{"B/z.flac": "B/z.mp3"},
+			mvs:  map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testCfg(t)
+
+			for _, trgRel := range tt.obs {
+				cfg.mf.Entries[trgRel] = &mfEntry{
+					SrcFile:    "old/" + trgRel,
+					SrcSize:    4,
+					SrcModTime: mfModTime(mtime),
+					Rule:       cfg.Cvs[0].String(),
+				}
+			}
+
+			var cvs []*WorkItem
+			for srcRel, trgRel := range tt.news {
+				path := filepath.Join(cfg.SrcDir.Path(), srcRel)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("flac"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+				f, err := file.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cvs = append(cvs, &WorkItem{
+					Kind:    ItemConvert,
+					SrcFile: f,
+					TrgFile: filepath.Join(cfg.TrgDir.Path(), trgRel),
+				})
+			}
+			sort.Slice(cvs, func(i, j int) bool { return cvs[i].TrgFile < cvs[j].TrgFile })
+
+			mvs, cvsRest, obsRest := detectMoves(cfg, cvs, tt.obs)
+
+			got := make(map[string]string)
+			for _, item := range mvs {
+				if item.Kind != ItemMove {
+					t.Errorf("kind of move item for '%s' is %v", item.TrgFile, item.Kind)
+				}
+				got[relPath(cfg.TrgDir.Path(), item.TrgFile)] = relPath(cfg.TrgDir.Path(), item.FromFile)
+			}
+			if !reflect.DeepEqual(got, tt.mvs) {
+				t.Errorf("moves: got %v, want %v", got, tt.mvs)
+			}
+			if n := len(tt.news) - len(tt.mvs); len(cvsRest) != n {
+				t.Errorf("remaining conversions: got %d, want %d", len(cvsRest), n)
+			}
+			if n := len(tt.obs) - len(tt.mvs); len(obsRest) != n {
+				t.Errorf("remaining obsolete files: got %d, want %d", len(obsRest), n)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package smsync
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -14,7 +15,7 @@ import (
 type cvAll2FLAC struct{}
 
 // exec executes the conversion to FLAC
-func (cvAll2FLAC) exec(srcFile string, trgFile string, cvStr string) error {
+func (cvAll2FLAC) exec(ctx context.Context, srcFile string, trgFile string, cvStr string) error {
 	var params []string
 
 	// set FLAC codec
@@ -24,7 +25,7 @@ func (cvAll2FLAC) exec(srcFile string, trgFile string, cvStr string) error {
 	params = append(params, "-compression_level", s.SplitMulti(cvStr, "|:")[1])
 
 	// execute ffmpeg
-	return execFFMPEG(srcFile, trgFile, &params)
+	return execFFMPEG(ctx, srcFile, trgFile, &params)
 }
 
 // normCvStr normalizes the conversion string: Blanks are removed and default
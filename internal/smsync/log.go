@@ -13,7 +13,8 @@ import (
 	"gitlab.com/go-utilities/file"
 )
 
-// LogFile is the log file. smsync always logs into ./smsync.log
+// LogFile is the log file. smsync always logs into smsync.log in the target
+// directory
 const LogFile = "smsync.log"
 
 // text formatting structure for gool
@@ -85,10 +86,12 @@ func (f *smsyncTextFormatter) Format(entry *log.Entry) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-// CreateLogger creates and initializes the logger for smsync
-func CreateLogger(level log.Level) error {
+// CreateLogger creates and initializes the logger for smsync. The log file is
+// created in the target directory trgDir. If trgDir is empty, the current
+// working directory is taken
+func CreateLogger(trgDir string, level log.Level) error {
 	// set log file
-	fp, err := filepath.Abs(filepath.Join(".", LogFile))
+	fp, err := filepath.Abs(filepath.Join(trgDir, LogFile))
 	if err != nil {
 		if _, e := fmt.Fprintln(os.Stderr, err); e != nil {
 			panic(e.Error())
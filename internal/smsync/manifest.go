@@ -0,0 +1,462 @@
+package smsync
+
+// manifest.go implements the sync manifest. The manifest is stored in the
+// target directory and records for every target file the source file it has
+// been created from, the size and modification time of that source file, the
+// conversion rule that has been applied and the size of the target file.
+// Change detection, the deletion of obsolete files and the continuation of
+// interrupted runs are based on the manifest.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// mfFile is the file name of the manifest (it's stored in the target
+// directory)
+const mfFile = "smsync.manifest.yaml"
+
+// mfSaveInterval is the number of manifest updates after which the manifest
+// is written to disk during processing. That limits the number of conversions
+// that get lost if smsync crashes
+const mfSaveInterval = 50
+
+// mfEntry is the manifest entry for one target file
+type mfEntry struct {
+	SrcFile    string `yaml:"source"`                // source file (relative to source dir)
+	SrcSize    int64  `yaml:"source_size"`           // size of source file
+	SrcModTime string `yaml:"source_mtime"`          // modification time of source file
+	SrcHash    string `yaml:"source_hash,omitempty"` // content hash of source file (only for change detection mode hash)
+	Rule       string `yaml:"rule"`                  // conversion rule that has been applied
+	TrgSize    int64  `yaml:"target_size"`           // size of target file
+}
+
+// mfProbe contains the properties of a source file that have been determined
+// with ffprobe. They are valid as long as size and modification time of the
+// source file are unchanged
+type mfProbe struct {
+	SrcSize    int64             `yaml:"source_size"`    // size of source file
+	SrcModTime string            `yaml:"source_mtime"`   // modification time of source file
+	Bitrate    int               `yaml:"bitrate"`        // bit rate in kbps
+	SampleRate int               `yaml:"sample_rate"`    // sample rate in Hz
+	Tags       map[string]string `yaml:"tags,omitempty"` // tags (only those that can be used in target paths)
+}
+
+// mfSample contains the result of the sample conversions of a rule with a
+// certain conversion, and the source files of the rule at that time
+type mfSample struct {
+	Comp    float64 `yaml:"compression"` // compression rate
+	Files   int     `yaml:"files"`       // number of source files of the rule
+	SrcSize uint64  `yaml:"source_size"` // total size of the source files of the rule
+	Time    string  `yaml:"time"`        // time of the sample conversions
+}
+
+// manifest contains the entries for all target files. Entries are keyed by
+// the target file path relative to the target directory. In addition, it
+// contains the properties of source files that are needed to evaluate rule
+// conditions. These are keyed by the source file path relative to the source
+// directory
+type manifest struct {
+	Entries map[string]*mfEntry  `yaml:"files"`
+	Probes  map[string]*mfProbe  `yaml:"probes,omitempty"`
+	Samples map[string]*mfSample `yaml:"sample_conversions,omitempty"` // results of sample conversions (see FitBudget)
+
+	path     string              // path of the manifest file
+	exists   bool                // manifest file has existed when smsync was started
+	seen     map[string]bool     // target files whose source has been found in the source tree
+	seenSrc  map[string]bool     // source files that have been found in the source tree
+	trgSrcs  map[string][]string // source files per target file (key: see collKey)
+	unknown  []string            // source directories whose files could not be checked since an override file is invalid
+	hashes   map[string]string   // content hashes of source files that have been calculated in this run
+	probed   map[string]bool     // source files whose properties have been requested in this run
+	updates  int                 // number of updates since the last save
+	readOnly bool                // manifest must not be written (dry run)
+	mu       sync.Mutex
+}
+
+// mfModTime returns the representation of a modification time that is
+// stored in the manifest
+func mfModTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// newMf creates an empty manifest for the target directory trgDir
+func newMf(trgDir string) *manifest {
+	return &manifest{
+		Entries: make(map[string]*mfEntry),
+		path:    filepath.Join(trgDir, mfFile),
+		seen:    make(map[string]bool),
+		seenSrc: make(map[string]bool),
+		trgSrcs: make(map[string][]string),
+		hashes:  make(map[string]string),
+		Probes:  make(map[string]*mfProbe),
+		Samples: make(map[string]*mfSample),
+		probed:  make(map[string]bool),
+	}
+}
+
+// readMf reads the manifest from the target directory trgDir. If no manifest
+// exists, an empty manifest is returned
+func readMf(trgDir string) (*manifest, error) {
+	log.Debug("smsync.readMf: BEGIN")
+	defer log.Debug("smsync.readMf: END")
+
+	mf := newMf(trgDir)
+
+	exists, err := file.Exists(mf.path)
+	if err != nil {
+		log.Errorf("readMf: %v", err)
+		return nil, fmt.Errorf("readMf: %v", err)
+	}
+	if !exists {
+		log.Info("No manifest found in target directory")
+		return mf, nil
+	}
+
+	b, err := os.ReadFile(mf.path)
+	if err != nil {
+		log.Errorf("readMf: %v", err)
+		return nil, fmt.Errorf("readMf: %v", err)
+	}
+	if err = yaml.Unmarshal(b, mf); err != nil {
+		log.Errorf("readMf: %v", err)
+		return nil, fmt.Errorf("Manifest '%s' cannot be read: %v", mf.path, err)
+	}
+	if mf.Entries == nil {
+		mf.Entries = make(map[string]*mfEntry)
+	}
+	if mf.Probes == nil {
+		mf.Probes = make(map[string]*mfProbe)
+	}
+	if mf.Samples == nil {
+		mf.Samples = make(map[string]*mfSample)
+	}
+	mf.exists = true
+
+	return mf, nil
+}
+
+// write writes the manifest to disk. It's first written to a temporary file
+// which is renamed afterwards. Thus, a crash during writing doesn't destroy
+// the manifest
+func (mf *manifest) write() {
+	log.Debug("smsync.manifest.write: BEGIN")
+	defer log.Debug("smsync.manifest.write: END")
+
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	if mf.readOnly {
+		return
+	}
+
+	out, err := yaml.Marshal(mf)
+	if err != nil {
+		log.Errorf("manifest.write: %v", err)
+		return
+	}
+	tmp := mf.path + ".tmp"
+	if err = os.WriteFile(tmp, out, 0644); err != nil {
+		log.Errorf("manifest.write: %v", err)
+		return
+	}
+	if err = os.Rename(tmp, mf.path); err != nil {
+		log.Errorf("manifest.write: %v", err)
+		return
+	}
+	mf.updates = 0
+}
+
+// get returns the manifest entry for the target file trgRel (relative to the
+// target directory)
+func (mf *manifest) get(trgRel string) (*mfEntry, bool) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	e, ok := mf.Entries[trgRel]
+	return e, ok
+}
+
+// see marks the target file trgRel and the source file srcRel as found in
+// the source tree
+func (mf *manifest) see(trgRel, srcRel string) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	mf.seen[trgRel] = true
+	mf.seenSrc[srcRel] = true
+}
+
+// markUnknown registers that the files of the source directory srcRel
+// (relative to the source directory) and its sub directories could not be
+// checked since an override file is invalid
+func (mf *manifest) markUnknown(srcRel string) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	mf.unknown = append(mf.unknown, srcRel)
+}
+
+// isUnknown returns true if the source file srcRel (relative to the source
+// directory) is located in a directory that has been marked as unknown.
+// mf.mu must be locked by the caller
+func (mf *manifest) isUnknown(srcRel string) bool {
+	for _, dir := range mf.unknown {
+		if dir == "." || strings.HasPrefix(srcRel, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sample returns the result of the sample conversion key
+func (mf *manifest) sample(key string) (*mfSample, bool) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	s, ok := mf.Samples[key]
+	return s, ok
+}
+
+// setSample stores the result s of the sample conversion key
+func (mf *manifest) setSample(key string, s *mfSample) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	mf.Samples[key] = s
+	mf.updates++
+}
+
+// claim registers that the source file srcRel is mapped to the target file
+// with the collision key key. It's used to detect source files that are
+// mapped to the same target file
+func (mf *manifest) claim(key, srcRel string) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	mf.trgSrcs[key] = append(mf.trgSrcs[key], srcRel)
+}
+
+// seenUnder returns true if target files in the directory dirRel (relative
+// to the target directory) or its sub directories have been found in the
+// source tree
+func (mf *manifest) seenUnder(dirRel string) bool {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	prefix := dirRel + string(filepath.Separator)
+	for trgRel := range mf.seen {
+		if strings.HasPrefix(trgRel, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// claims returns the source files (relative to the source directory) per
+// collision key of their target files (see claim). claims must be called
+// after the source tree has been traversed
+func (mf *manifest) claims() map[string][]string {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	keys := make(map[string][]string, len(mf.trgSrcs))
+	for k, srcRels := range mf.trgSrcs {
+		keys[k] = append([]string{}, srcRels...)
+	}
+	return keys
+}
+
+// set creates or updates the manifest entry for the target file trgRel. If
+// the number of updates since the last save exceeds mfSaveInterval, the
+// manifest is written to disk
+func (mf *manifest) set(trgRel string, e *mfEntry) {
+	mf.mu.Lock()
+	mf.Entries[trgRel] = e
+	mf.updates++
+	save := mf.updates >= mfSaveInterval
+	mf.mu.Unlock()
+
+	if save {
+		mf.write()
+	}
+}
+
+// remove deletes the manifest entry for the target file trgRel
+func (mf *manifest) remove(trgRel string) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	delete(mf.Entries, trgRel)
+	mf.updates++
+}
+
+// move moves the manifest entry of the target file fromRel to trgRel. The
+// entry is updated with the moved source file srcFile (with path srcRel
+// relative to the source directory)
+func (mf *manifest) move(fromRel, trgRel, srcRel string, srcFile file.Info) {
+	mf.mu.Lock()
+	e, ok := mf.Entries[fromRel]
+	if !ok {
+		mf.mu.Unlock()
+		return
+	}
+	delete(mf.Entries, fromRel)
+	mf.mu.Unlock()
+
+	u := *e
+	u.SrcFile = srcRel
+	u.SrcModTime = mfModTime(srcFile.ModTime())
+	mf.set(trgRel, &u)
+}
+
+// obsolete returns the target files (relative to the target directory) whose
+// source file doesn't exist anymore, is out of scope or has been mapped to
+// another target file. inScope determines whether a source file (relative to
+// the source directory) exists and is in scope. If scopeChg is true (i.e.
+// rules or exclusions have been changed since the last sync), all target
+// files whose source file has not been found in the source tree are obsolete.
+// In both cases, target files whose source file is located in a directory that
+// has been marked as unknown are never obsolete, since their source files
+// could not be checked. obsolete must be called after the source tree has
+// been traversed
+func (mf *manifest) obsolete(scopeChg bool, inScope func(string) bool) (trgRels []string) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	for trgRel, e := range mf.Entries {
+		if mf.seen[trgRel] || mf.isUnknown(e.SrcFile) {
+			continue
+		}
+		if mf.seenSrc[e.SrcFile] || scopeChg {
+			trgRels = append(trgRels, trgRel)
+			continue
+		}
+		if !inScope(e.SrcFile) {
+			trgRels = append(trgRels, trgRel)
+		}
+	}
+	return trgRels
+}
+
+// probe returns the properties of the source file srcFile (with path srcRel
+// relative to the source directory). If they are stored in the manifest and
+// the source file hasn't been changed since, they are taken from there.
+// Otherwise they are determined with ffprobe and stored in the manifest
+func (mf *manifest) probe(srcRel string, srcFile file.Info) (*mfProbe, error) {
+	mf.mu.Lock()
+	mf.probed[srcRel] = true
+	p, ok := mf.Probes[srcRel]
+	mf.mu.Unlock()
+
+	if ok && p.SrcSize == srcFile.Size() && p.SrcModTime == mfModTime(srcFile.ModTime()) {
+		return p, nil
+	}
+
+	info, err := execFFPROBE(srcFile.Path())
+	if err != nil {
+		return nil, err
+	}
+	p = &mfProbe{
+		SrcSize:    srcFile.Size(),
+		SrcModTime: mfModTime(srcFile.ModTime()),
+		Bitrate:    info.bitrate,
+		SampleRate: info.sampleRate,
+		Tags:       info.tags,
+	}
+
+	mf.mu.Lock()
+	mf.Probes[srcRel] = p
+	mf.updates++
+	mf.mu.Unlock()
+
+	return p, nil
+}
+
+// dropProbes removes the properties of source files that have not been
+// requested in this run (since the source files don't exist anymore or are
+// not affected by rule conditions anymore). dropProbes must be called after
+// the source tree has been traversed
+func (mf *manifest) dropProbes() {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	for srcRel := range mf.Probes {
+		if !mf.probed[srcRel] {
+			delete(mf.Probes, srcRel)
+			mf.updates++
+		}
+	}
+}
+
+// cacheHash stores the content hash of the source file srcRel, so that it
+// doesn't need to be calculated again in this run
+func (mf *manifest) cacheHash(srcRel, hash string) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	mf.hashes[srcRel] = hash
+}
+
+// srcHash returns the content hash of the source file srcFile (with path
+// srcRel relative to the source directory). If it has already been calculated
+// in this run, it's taken from the cache
+func (mf *manifest) srcHash(srcRel string, srcFile file.Info) (string, error) {
+	mf.mu.Lock()
+	hash, ok := mf.hashes[srcRel]
+	mf.mu.Unlock()
+
+	if ok {
+		return hash, nil
+	}
+	hash, err := fileHash(srcFile.Path())
+	if err != nil {
+		return "", err
+	}
+	mf.cacheHash(srcRel, hash)
+	return hash, nil
+}
+
+// newMfEntry creates a manifest entry from the source file srcFile (with path
+// srcRel relative to the source directory and content hash srcHash), the
+// target file trgFile and the conversion rule cv
+func newMfEntry(srcRel string, srcFile file.Info, srcHash string, trgFile file.Info, cv *cvm) *mfEntry {
+	e := &mfEntry{
+		SrcFile:    srcRel,
+		SrcSize:    srcFile.Size(),
+		SrcModTime: mfModTime(srcFile.ModTime()),
+		SrcHash:    srcHash,
+		Rule:       cv.String(),
+	}
+	if trgFile != nil {
+		e.TrgSize = trgFile.Size()
+	}
+	return e
+}
+
+// fileHash calculates the SHA-256 hash of the content of the file path
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("fileHash: %v", err)
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		log.Errorf("fileHash: %v", err)
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -1,6 +1,7 @@
 package smsync
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
@@ -13,7 +14,7 @@ import (
 type cvAll2MP3 struct{}
 
 // exec executes the conversion to MP3
-func (cv cvAll2MP3) exec(srcFile string, trgFile string, cvStr string) error {
+func (cv cvAll2MP3) exec(ctx context.Context, srcFile string, trgFile string, cvStr string) error {
 	var params []string
 
 	// set MP3 codec
@@ -34,7 +35,7 @@ func (cv cvAll2MP3) exec(srcFile string, trgFile string, cvStr string) error {
 	params = append(params, "-compression_level", a[3])
 
 	//execute ffmpeg
-	return execFFMPEG(srcFile, trgFile, &params)
+	return execFFMPEG(ctx, srcFile, trgFile, &params)
 }
 
 // normCvStr normalizes the conversion string: Blanks are removed and default
@@ -1,6 +1,7 @@
 package smsync
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -14,7 +15,7 @@ import (
 type cvAll2OGG struct{}
 
 // exec executes the conversion to OGG
-func (cv cvAll2OGG) exec(srcFile string, trgFile string, cvStr string) error {
+func (cv cvAll2OGG) exec(ctx context.Context, srcFile string, trgFile string, cvStr string) error {
 	var params []string
 
 	// set vorbis codec
@@ -30,7 +31,7 @@ func (cv cvAll2OGG) exec(srcFile string, trgFile string, cvStr string) error {
 	}
 
 	//execute ffmpeg
-	return execFFMPEG(srcFile, trgFile, &params)
+	return execFFMPEG(ctx, srcFile, trgFile, &params)
 }
 
 // normCvStr normalizes the conversion string: Blanks are removed and default
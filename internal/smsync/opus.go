@@ -1,6 +1,7 @@
 package smsync
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -13,7 +14,7 @@ import (
 type cvAll2OPUS struct{}
 
 // exec executes the conversion to OPUS
-func (cv cvAll2OPUS) exec(srcFile string, trgFile string, cvStr string) error {
+func (cv cvAll2OPUS) exec(ctx context.Context, srcFile string, trgFile string, cvStr string) error {
 	var params []string
 
 	// set OPUS codec
@@ -38,7 +39,7 @@ func (cv cvAll2OPUS) exec(srcFile string, trgFile string, cvStr string) error {
 	params = append(params, "-compression_level", a[3])
 
 	// execute ffmpeg
-	return execFFMPEG(srcFile, trgFile, &params)
+	return execFFMPEG(ctx, srcFile, trgFile, &params)
 }
 
 // normCvStr normalizes the conversion string: Blanks are removed and default
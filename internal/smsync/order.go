@@ -0,0 +1,94 @@
+package smsync
+
+// order.go implements the processing order of conversions. Conversions are
+// grouped by albums (i.e. by the directory of their source file), and the
+// albums are sorted according to the configured order. Within an album, the
+// files are sorted by path. Thus, if the processing is stopped, only the
+// albums whose conversions are running are incomplete, and the free space on
+// the target device can be checked per album.
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// constants for the processing order
+const (
+	OrderPath     = "path"     // albums in lexical order of their path
+	OrderNewest   = "newest"   // albums with the most recently modified source file first
+	OrderSmallest = "smallest" // albums with the smallest total size of source files first
+	OrderPriority = "priority" // albums in the directories of the priority list first (in the order of that list), then by path
+)
+
+// album contains the conversions of the source files of one directory
+type album struct {
+	dir   string      // source directory
+	items []*WorkItem // conversions (sorted by path)
+	size  int64       // total size of the source files
+	mtime int64       // modification time of the most recently modified source file (unix nano seconds)
+	prio  int         // index of the first matching entry of the priority list (len of the list if none matches)
+}
+
+// albumOf returns the album (i.e. the source directory) of the conversion
+// item
+func albumOf(item *WorkItem) string {
+	return filepath.Dir(item.SrcFile.Path())
+}
+
+// orderCvs sorts the conversions cvs according to the processing order of
+// the configuration. Conversions of the same album are kept together
+func orderCvs(cfg *Config, cvs []*WorkItem) []*WorkItem {
+	// group conversions by album
+	albums := make(map[string]*album)
+	for _, item := range cvs {
+		dir := albumOf(item)
+		a, ok := albums[dir]
+		if !ok {
+			a = &album{dir: dir, prio: len(cfg.Priority)}
+			for i, p := range cfg.Priority {
+				if matchTree(p, relPath(cfg.SrcDir.Path(), dir)) {
+					a.prio = i
+					break
+				}
+			}
+			albums[dir] = a
+		}
+		a.items = append(a.items, item)
+		a.size += item.SrcFile.Size()
+		if t := item.SrcFile.ModTime().UnixNano(); t > a.mtime {
+			a.mtime = t
+		}
+	}
+
+	var as []*album
+	for _, a := range albums {
+		sort.Slice(a.items, func(i, j int) bool { return a.items[i].SrcFile.Path() < a.items[j].SrcFile.Path() })
+		as = append(as, a)
+	}
+
+	// sort albums. The path is always the last criterion to get a
+	// deterministic order
+	sort.Slice(as, func(i, j int) bool {
+		switch cfg.Order {
+		case OrderNewest:
+			if as[i].mtime != as[j].mtime {
+				return as[i].mtime > as[j].mtime
+			}
+		case OrderSmallest:
+			if as[i].size != as[j].size {
+				return as[i].size < as[j].size
+			}
+		case OrderPriority:
+			if as[i].prio != as[j].prio {
+				return as[i].prio < as[j].prio
+			}
+		}
+		return as[i].dir < as[j].dir
+	})
+
+	sorted := make([]*WorkItem, 0, len(cvs))
+	for _, a := range as {
+		sorted = append(sorted, a.items...)
+	}
+	return sorted
+}
@@ -0,0 +1,67 @@
+package smsync
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testInfo implements file.Info without a file
+type testInfo struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+func (i testInfo) Name() string       { return filepath.Base(i.path) }
+func (i testInfo) Size() int64        { return i.size }
+func (i testInfo) Mode() os.FileMode  { return 0644 }
+func (i testInfo) ModTime() time.Time { return i.mtime }
+func (i testInfo) IsDir() bool        { return false }
+func (i testInfo) Sys() interface{}   { return nil }
+func (i testInfo) Path() string       { return i.path }
+
+func TestOrderCvs(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// albums: A (2 files, 30 bytes, oldest), B (1 file, 5 bytes, newest) and
+	// C/D (1 file, 100 bytes)
+	var cvs []*WorkItem
+	for _, f := range []testInfo{
+		{"/src/C/D/1.flac", 100, t0.Add(2 * time.Hour)},
+		{"/src/A/2.flac", 20, t0},
+		{"/src/B/1.flac", 5, t0.Add(3 * time.Hour)},
+		{"/src/A/1.flac", 10, t0.Add(time.Hour)},
+	} {
+		cvs = append(cvs, &WorkItem{Kind: ItemConvert, SrcFile: f})
+	}
+
+	tests := []struct {
+		order    string
+		priority []string
+		want     []string
+	}{
+		{OrderPath, nil, []string{"/src/A/1.flac", "/src/A/2.flac", "/src/B/1.flac", "/src/C/D/1.flac"}},
+		{OrderNewest, nil, []string{"/src/B/1.flac", "/src/C/D/1.flac", "/src/A/1.flac", "/src/A/2.flac"}},
+		{OrderSmallest, nil, []string{"/src/B/1.flac", "/src/A/1.flac", "/src/A/2.flac", "/src/C/D/1.flac"}},
+		{OrderPriority, []string{"C", "B"}, []string{"/src/C/D/1.flac", "/src/B/1.flac", "/src/A/1.flac", "/src/A/2.flac"}},
+		{OrderPriority, []string{"*/D"}, []string{"/src/C/D/1.flac", "/src/A/1.flac", "/src/A/2.flac", "/src/B/1.flac"}},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{
+			SrcDir:   testInfo{path: "/src"},
+			Order:    tt.order,
+			Priority: tt.priority,
+		}
+		var got []string
+		for _, item := range orderCvs(cfg, cvs) {
+			got = append(got, item.SrcFile.Path())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orderCvs(%s %v) = %v, want %v", tt.order, tt.priority, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package smsync
+
+// override.go implements override files in the source tree. An override file
+// can be stored in any source directory. It overrides or extends the
+// conversion rules of the target for the sub tree of that directory, or it
+// excludes the sub tree from certain targets. Override files are inherited
+// down the directory tree: The rules of an override file are applied on top
+// of the effective rules of the parent directory.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+	fp "gitlab.com/go-utilities/filepath"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ovrFile is the name of override files in the source tree
+const ovrFile = ".smsync.yaml"
+
+// ovrYml is used to read override files
+type ovrYml struct {
+	Rules    []rule   `yaml:"rules,omitempty"`           // rules that override or extend the rules of the target
+	ExclTrgs []string `yaml:"exclude_targets,omitempty"` // names of targets the directory is excluded from
+}
+
+// ovr contains the effective settings for one source directory
+type ovr struct {
+	cvs  []*cvm // effective conversion rules (in the order of evaluation)
+	excl bool   // directory is excluded from the target
+	err  error  // override file of the directory or of a parent directory is invalid
+}
+
+// overrides caches the effective settings of the source directories
+type overrides struct {
+	dirs map[string]*ovr   // effective settings per source directory
+	sums map[string]string // content hashes of the override files that have been read (key: source directory relative to the source dir)
+	mu   sync.Mutex
+}
+
+// newOvrs creates an empty override cache
+func newOvrs() *overrides {
+	return &overrides{dirs: make(map[string]*ovr), sums: make(map[string]string)}
+}
+
+// dirOvr returns the effective settings for the source directory dir. They
+// are determined from the override file of dir (if there's one) and the
+// effective settings of the parent directory
+func (cfg *Config) dirOvr(dir string) *ovr {
+	cfg.ovrs.mu.Lock()
+	o, ok := cfg.ovrs.dirs[dir]
+	cfg.ovrs.mu.Unlock()
+	if ok {
+		return o
+	}
+
+	// the source directory itself inherits the rules of the target.
+	// Directories outside of the source directory have the rules of the
+	// target
+	var parent = &ovr{cvs: cfg.Cvs}
+	if sub, _ := fp.IsSub(cfg.SrcDir.Path(), dir); !sub {
+		return parent
+	}
+	if dir != cfg.SrcDir.Path() {
+		parent = cfg.dirOvr(filepath.Dir(dir))
+	}
+
+	o = cfg.readOvr(dir, parent)
+
+	cfg.ovrs.mu.Lock()
+	cfg.ovrs.dirs[dir] = o
+	cfg.ovrs.mu.Unlock()
+
+	return o
+}
+
+// readOvr reads the override file of the source directory dir (if there's
+// one) and applies it to the effective settings of the parent directory
+func (cfg *Config) readOvr(dir string, parent *ovr) *ovr {
+	path := filepath.Join(dir, ovrFile)
+
+	// if the parent is invalid or excluded, dir is as well. If dir doesn't
+	// have an override file, it inherits the settings of the parent
+	if parent.err != nil || parent.excl {
+		return parent
+	}
+	exists, err := file.Exists(path)
+	if err != nil {
+		log.Errorf("readOvr: %v", err)
+		return &ovr{err: err}
+	}
+	if !exists {
+		return parent
+	}
+
+	log.Infof("Read override file '%s'", path)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Errorf("readOvr: %v", err)
+		return &ovr{err: err}
+	}
+	cfg.ovrs.mu.Lock()
+	cfg.ovrs.sums[relPath(cfg.SrcDir.Path(), dir)] = fmt.Sprintf("%x", sha256.Sum256(b))
+	cfg.ovrs.mu.Unlock()
+
+	var ovrY ovrYml
+	if err = yaml.Unmarshal(b, &ovrY); err != nil {
+		log.Errorf("readOvr: Override file '%s' cannot be read: %v", path, err)
+		return &ovr{err: fmt.Errorf("Override file '%s' cannot be read: %v", path, err)}
+	}
+
+	// check if directory is excluded from the target
+	for _, name := range ovrY.ExclTrgs {
+		if name == cfg.Name {
+			log.Infof("Directory '%s' is excluded from target '%s' per override file", dir, cfg.Name)
+			return &ovr{excl: true}
+		}
+	}
+
+	if len(ovrY.Rules) == 0 {
+		return parent
+	}
+
+	// rules of the override file are evaluated before the rules of the
+	// parent. Thus, they replace the rules of the parent for the same source
+	// suffix and extend them otherwise
+	var cvs []*cvm
+	for i, r := range ovrY.Rules {
+		c, err := getRule(cvs, &r, i+1)
+		if err == nil && c.ladder != nil {
+			err = fmt.Errorf("Rule #%d: ladders are only supported in the configuration file of the target", i+1)
+		}
+		if err != nil {
+			log.Errorf("readOvr: Override file '%s': %v", path, err)
+			return &ovr{err: fmt.Errorf("Override file '%s': %v", path, err)}
+		}
+		cvs = append(cvs, c)
+	}
+	cvs = append(cvs, parent.cvs...)
+
+	return &ovr{cvs: cvs}
+}
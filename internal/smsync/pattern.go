@@ -0,0 +1,85 @@
+package smsync
+
+// pattern.go implements the path patterns that are used for inclusions and
+// exclusions. Patterns are interpreted relative to the source directory. They
+// consist of segments separated by "/". Each segment is matched against one
+// path element using the syntax of path.Match. The segment "**" matches any
+// number (including zero) of path elements.
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// patternAny is the pattern segment that matches any number of path elements
+const patternAny = "**"
+
+// checkPattern verifies that p is a valid pattern
+func checkPattern(p string) error {
+	if p == "" || path.IsAbs(p) {
+		return fmt.Errorf("'%s' is not a valid pattern: patterns must be relative to the source directory", p)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("'%s' is not a valid pattern: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// matchPattern returns true if the path rel (relative to the source
+// directory) matches the pattern p
+func matchPattern(p, rel string) bool {
+	return matchSegs(strings.Split(p, "/"), strings.Split(filepath.ToSlash(rel), "/"))
+}
+
+// matchTree returns true if the path rel (relative to the source directory)
+// or one of its parent directories matches the pattern p. I.e. a pattern
+// that matches a directory matches the entire sub tree
+func matchTree(p, rel string) bool {
+	pSegs := strings.Split(p, "/")
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	for i := 1; i <= len(elems); i++ {
+		if matchSegs(pSegs, elems[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny returns true if rel matches at least one of the patterns ps
+func matchAny(ps []string, rel string) bool {
+	for _, p := range ps {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegs returns true if the path elements elems match the pattern
+// segments pSegs
+func matchSegs(pSegs, elems []string) bool {
+	for len(pSegs) > 0 {
+		if pSegs[0] == patternAny {
+			// "**" matches zero or more path elements: try all possible
+			// remainders
+			for i := 0; i <= len(elems); i++ {
+				if matchSegs(pSegs[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pSegs[0], elems[0]); !ok {
+			return false
+		}
+		pSegs, elems = pSegs[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
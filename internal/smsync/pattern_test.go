@@ -0,0 +1,40 @@
+package smsync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchSegs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"*.flac", "x.flac", true},
+		{"*.flac", "a/x.flac", false},
+		{"**", "a/b/c", true},
+		{"**/*.flac", "x.flac", true},
+		{"**/*.flac", "a/b/x.flac", true},
+		{"**/*.flac", "a/b/x.mp3", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/c", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/d/c", true},
+		{"a/**/c", "a/b/d", false},
+		{"**/live/**", "x/live/y.flac", true},
+		{"**/live/**", "x/alive/y.flac", false},
+		{"[ab]/x", "b/x", true},
+		{"[ab]/x", "c/x", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchSegs(strings.Split(tt.pattern, "/"), strings.Split(tt.rel, "/")); got != tt.want {
+			t.Errorf("matchSegs(%s, %s) = %v, want %v", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
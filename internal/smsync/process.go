@@ -1,7 +1,11 @@
 package smsync
 
 import (
+	"context"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/ricochet2200/go-disk-usage/du"
@@ -15,13 +19,20 @@ type (
 	procOut struct {
 		srcFile file.Info     // source file
 		trgFile file.Info     // target file
+		trgPath string        // path of target file
+		frmPath string        // path of the target file that has been moved (only for moves)
+		srcHash string        // content hash of source file (only for change detection mode hash)
+		linkTo  string        // target of the symbolic link (only for links)
 		dur     time.Duration // duration of conversion
 		err     error         // error (that occurred during the conversion)
 	}
-	// ProcInfo contains information about the conversion of a single file
+	// ProcInfo contains information about the processing of a single work
+	// list item
 	ProcInfo struct {
-		SrcFile file.Info     // source file or directory
-		TrgFile file.Info     // target file or directory
+		Kind    ItemKind      // kind of work list item
+		SrcFile file.Info     // source file
+		TrgFile file.Info     // target file
+		TrgPath string        // path of the target file
 		Dur     time.Duration // duration of a conversion
 		Err     error         // error (that occurred during processing)
 	}
@@ -29,24 +40,35 @@ type (
 
 // Process contains the data to control the sync process
 type Process struct {
-	pl      *wp.Pool      // worker pool
-	Trck    *Tracking     // progress tracking
-	cfg     *Config       // smsync config
-	files   *[]*file.Info // list of files that need to be synched
-	init    bool          // called in init mode?
-	cleanup chan struct{} // start cleanup
-	done    chan struct{} // report processing to be done
-	stopped bool          // processing has been stopped?
+	pl      *wp.Pool           // worker pool
+	Trck    *Tracking          // progress tracking
+	cfg     *Config            // smsync config
+	wl      *[]*WorkItem       // work list: files that need to be synched
+	init    bool               // called in init mode?
+	ctx     context.Context    // context of running conversions
+	cancel  context.CancelFunc // cancels running conversions
+	dirs    map[string]bool    // target directories that might be empty after deletions and moves
+	dels    sync.WaitGroup     // deletions that are running
+	space   *spaceGuard        // guard for the free space on the target device (nil if there's no reserve)
+	skipped []*WorkItem        // conversions that have not been started due to low disk space
+	cleanup chan struct{}      // start cleanup
+	done    chan struct{}      // report processing to be done
+	stopped bool               // processing has been stopped?
+	stop    chan struct{}      // closed if processing is stopped
+	stopOnc sync.Once          // makes sure that stop is closed only once
 }
 
 // constants for task names, needed for workerpool
 const (
-	taskNameDir  = "process directory"
-	taskNameFile = "convert file"
+	taskNameDelete = "delete file"
+	taskNameFile   = "convert file"
+	taskNameMove   = "move file"
+	taskNameDelDir = "delete directory"
+	taskNameLink   = "create link"
 )
 
 // NewProcess create a new process object
-func NewProcess(cfg *Config, files *[]*file.Info, init bool) *Process {
+func NewProcess(cfg *Config, wl *[]*WorkItem, init bool) *Process {
 	log.Debug("smsync.NewProcess: BEGIN")
 	defer log.Debug("smsync.NewProcess: END")
 
@@ -56,16 +78,22 @@ func NewProcess(cfg *Config, files *[]*file.Info, init bool) *Process {
 	proc.pl = wp.NewPool(cfg.NumWrkrs)
 
 	// set up progress tracking
-	proc.Trck = newTrck(files, du.NewDiskUsage(cfg.TrgDir.Path()).Available()) // tracking
+	proc.Trck = newTrck(wl, du.NewDiskUsage(cfg.TrgDir.Path()).Available()) // tracking
+
+	// create context to be able to cancel running conversions
+	proc.ctx, proc.cancel = context.WithCancel(context.Background())
 
 	// make channels
 	proc.cleanup = make(chan struct{})
 	proc.done = make(chan struct{})
+	proc.stop = make(chan struct{})
 
 	// store sync parameters
 	proc.cfg = cfg
-	proc.files = files
+	proc.wl = wl
 	proc.init = init
+	proc.dirs = make(map[string]bool)
+	proc.space = newSpaceGuard(cfg.TrgDir.Path(), cfg.MinFree)
 
 	return proc
 }
@@ -84,11 +112,19 @@ func (proc *Process) cleanUp() {
 	// remove temporary files
 	CleanUp(proc.cfg)
 
-	// update config file
-	if !proc.stopped {
+	// save manifest. This is done also if processing has been stopped since
+	// the manifest is the basis for the continuation in the next run
+	proc.cfg.mf.write()
+
+	// update config file. That's not done if conversions have been skipped
+	// due to low disk space
+	if !proc.stopped && len(proc.skipped) == 0 {
 		proc.cfg.setProcEnd()
 	}
 
+	// release context
+	proc.cancel()
+
 	// processing finished
 	close(proc.done)
 }
@@ -99,13 +135,13 @@ func (proc *Process) Run() {
 	defer log.Debug("smsync.Process.Run: END")
 
 	// if no files need to be synched: exit
-	if len(*proc.files) == 0 {
+	if len(*proc.wl) == 0 {
 		log.Info("Nothing to process")
 		return
 	}
 
 	// remove potentially existing error directory from last run
-	if err := os.RemoveAll(errDir); err != nil {
+	if err := os.RemoveAll(filepath.Join(proc.cfg.TrgDir.Path(), errDir)); err != nil {
 		log.Errorf("Process: %v", err)
 		return
 	}
@@ -113,7 +149,8 @@ func (proc *Process) Run() {
 	// delete all entries of the target directory if requested per cli option
 	if proc.init {
 		log.Info("Delete all entries of the target directory per cli option")
-		deleteTrg(proc.cfg.TrgDir.Path())
+		deleteTrg(proc.cfg)
+		proc.cfg.mf.write()
 	}
 
 	go func() {
@@ -125,63 +162,253 @@ func (proc *Process) Run() {
 
 		// fill worklist with files and close worklist channel
 		go func() {
-			for _, f := range *proc.files {
+			// conversions per album. The free space is checked per album, so
+			// that an album is either synchronized completely or not at all
+			albums := make(map[string][]*WorkItem)
+			for _, item := range *proc.wl {
+				if item.Kind == ItemConvert {
+					albums[albumOf(item)] = append(albums[albumOf(item)], item)
+				}
+			}
+			fits := make(map[string]bool)
+
+			// deletions are at the head of the work list. They must be
+			// finished before other items are processed, so that the space
+			// they free is available and no item refers to a deleted file
+			deleting := false
+		loop:
+			for _, item := range *proc.wl {
+				// if processing has been stopped, no further items are sent
+				select {
+				case <-proc.stop:
+					break loop
+				default:
+				}
+
+				if item.Kind == ItemDelete || item.Kind == ItemDeleteDir {
+					proc.dels.Add(1)
+					deleting = true
+				} else if deleting {
+					proc.waitDels()
+					deleting = false
+				}
+
 				// send task to the worker pool, distinguishing between
-				// directories and files. Files need to be converted, for
-				// directories, obsolete files might need to be deleted
-				if (*f).IsDir() {
-					proc.pl.In <- wp.Task{
-						Name: taskNameDir,
-						F: func(i interface{}) interface{} {
-							deleteObsoleteFiles(proc.cfg, i.(file.Info))
-							return i.(file.Info)
-						},
-						In: *f}
-				} else {
+				// conversions and deletions
+				switch item.Kind {
+				case ItemConvert:
+					// conversions are only started as long as the free
+					// space on the target device stays above the reserve.
+					// That's checked with the first conversion of an album
+					// for the entire album. Other items don't need
+					// additional space
+					album := albumOf(item)
+					ok, checked := fits[album]
+					if !checked {
+						ok = proc.space.reserve(albums[album])
+						fits[album] = ok
+					}
+					if !ok {
+						log.Warningf("'%s' is not synchronized due to low disk space", item.SrcFile.Path())
+						proc.skipped = append(proc.skipped, item)
+						continue
+					}
 					proc.pl.In <- wp.Task{
 						Name: taskNameFile,
 						F: func(i interface{}) interface{} {
-							cvOut := convert(proc.cfg, i.(file.Info))
-							return procOut{srcFile: i.(file.Info),
+							cvOut := convert(proc.ctx, proc.cfg, i.(*WorkItem).SrcFile)
+							return procOut{srcFile: i.(*WorkItem).SrcFile,
 								trgFile: cvOut.trgFile,
+								trgPath: i.(*WorkItem).TrgFile,
+								srcHash: proc.srcHash(i.(*WorkItem).SrcFile),
 								dur:     cvOut.dur,
 								err:     cvOut.err}
 						},
-						In: *f}
+						In: item}
+				case ItemDelete:
+					proc.pl.In <- wp.Task{
+						Name: taskNameDelete,
+						F: func(i interface{}) interface{} {
+							return procOut{trgPath: i.(*WorkItem).TrgFile,
+								err: deleteObsoleteFile(proc.cfg, i.(*WorkItem).TrgFile)}
+						},
+						In: item}
+				case ItemMove:
+					proc.pl.In <- wp.Task{
+						Name: taskNameMove,
+						F: func(i interface{}) interface{} {
+							item := i.(*WorkItem)
+							return procOut{srcFile: item.SrcFile,
+								trgPath: item.TrgFile,
+								frmPath: item.FromFile,
+								err:     moveTrgFile(proc.cfg, item.FromFile, item.TrgFile)}
+						},
+						In: item}
+				case ItemDeleteDir:
+					proc.pl.In <- wp.Task{
+						Name: taskNameDelDir,
+						F: func(i interface{}) interface{} {
+							return procOut{trgPath: i.(*WorkItem).TrgFile,
+								err: deleteExclDir(proc.cfg, i.(*WorkItem).TrgFile)}
+						},
+						In: item}
+				case ItemLink:
+					proc.pl.In <- wp.Task{
+						Name: taskNameLink,
+						F: func(i interface{}) interface{} {
+							item := i.(*WorkItem)
+							return procOut{srcFile: item.SrcFile,
+								trgPath: item.TrgFile,
+								linkTo:  item.LinkTo,
+								err:     createLink(proc.cfg, item.TrgFile, item.LinkTo)}
+						},
+						In: item}
 				}
 			}
 			close(proc.pl.In)
 		}()
 
-		// retrieve worker results and update tracking
+		// retrieve worker results, update manifest and tracking
 		for res := range proc.pl.Out {
+			out := res.Out.(procOut)
 			switch res.Name {
-			case taskNameDir:
-				proc.Trck.update(ProcInfo{SrcFile: res.Out.(file.Info),
-					TrgFile: nil,
-					Dur:     0,
-					Err:     nil})
+			case taskNameDelete:
+				proc.dels.Done()
+				if out.err == nil {
+					proc.cfg.mf.remove(relPath(proc.cfg.TrgDir.Path(), out.trgPath))
+					proc.dirs[filepath.Dir(out.trgPath)] = true
+				}
+				proc.Trck.update(ProcInfo{Kind: ItemDelete,
+					TrgPath: out.trgPath,
+					Err:     out.err})
+			case taskNameLink:
+				if out.err == nil {
+					proc.cfg.mf.set(relPath(proc.cfg.TrgDir.Path(), out.trgPath),
+						newLinkMfEntry(relPath(proc.cfg.SrcDir.Path(), out.srcFile.Path()), out.srcFile, out.linkTo))
+				}
+				proc.Trck.update(ProcInfo{Kind: ItemLink,
+					TrgPath: out.trgPath,
+					Err:     out.err})
+			case taskNameDelDir:
+				proc.dels.Done()
+				if out.err == nil {
+					proc.dirs[filepath.Dir(out.trgPath)] = true
+				}
+				proc.Trck.update(ProcInfo{Kind: ItemDeleteDir,
+					TrgPath: out.trgPath,
+					Err:     out.err})
+			case taskNameMove:
+				if out.err == nil {
+					proc.cfg.mf.move(relPath(proc.cfg.TrgDir.Path(), out.frmPath),
+						relPath(proc.cfg.TrgDir.Path(), out.trgPath),
+						relPath(proc.cfg.SrcDir.Path(), out.srcFile.Path()),
+						out.srcFile)
+					proc.dirs[filepath.Dir(out.frmPath)] = true
+				}
+				proc.Trck.update(ProcInfo{Kind: ItemMove,
+					SrcFile: out.srcFile,
+					TrgPath: out.trgPath,
+					Err:     out.err})
 			case taskNameFile:
-				proc.Trck.update(ProcInfo{SrcFile: res.Out.(procOut).srcFile,
-					TrgFile: res.Out.(procOut).trgFile,
-					Dur:     res.Out.(procOut).dur,
-					Err:     res.Out.(procOut).err})
+				if out.err == nil && out.trgFile != nil {
+					proc.updateMf(out.srcFile, out.srcHash, out.trgFile)
+				}
+				proc.Trck.update(ProcInfo{Kind: ItemConvert,
+					SrcFile: out.srcFile,
+					TrgFile: out.trgFile,
+					TrgPath: out.trgPath,
+					Dur:     out.dur,
+					Err:     out.err})
+				proc.space.release(out.srcFile.Path(), proc.Trck.Comp)
 			default:
 				log.Warningf("Task name '%s' received", res.Name)
 			}
 		}
+
+		// delete target directories that are empty after deletions and
+		// moves. This is done after all workers are finished, since a
+		// conversion might have created a directory in the meantime
+		proc.deleteEmptyDirs()
 	}()
 
 	// cleaning up
 	go proc.cleanUp()
 }
 
-// Stop stops the sync process
+// waitDels waits until the running deletions are finished or until the
+// processing is stopped
+func (proc *Process) waitDels() {
+	done := make(chan struct{})
+	go func() {
+		proc.dels.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-proc.stop:
+	}
+}
+
+// srcHash returns the content hash of srcFile if the change detection mode is
+// hash. Otherwise, an empty string is returned
+func (proc *Process) srcHash(srcFile file.Info) string {
+	if proc.cfg.ChgDetect != ChgDetectHash {
+		return ""
+	}
+	hash, err := proc.cfg.mf.srcHash(relPath(proc.cfg.SrcDir.Path(), srcFile.Path()), srcFile)
+	if err != nil {
+		log.Errorf("Process.srcHash: %v", err)
+		return ""
+	}
+	return hash
+}
+
+// updateMf updates the manifest entry for the target file trgFile after it
+// has been created successfully from srcFile
+func (proc *Process) updateMf(srcFile file.Info, srcHash string, trgFile file.Info) {
+	cv, ok := proc.cfg.getCv(srcFile.Path())
+	if !ok {
+		return
+	}
+	proc.cfg.mf.set(relPath(proc.cfg.TrgDir.Path(), trgFile.Path()),
+		newMfEntry(relPath(proc.cfg.SrcDir.Path(), srcFile.Path()), srcFile, srcHash, trgFile, cv))
+}
+
+// deleteEmptyDirs deletes the target directories that have become empty due
+// to deletions and moves. Sub directories are processed before their parents
+func (proc *Process) deleteEmptyDirs() {
+	var dirs []string
+	for dir := range proc.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		deleteEmptyDirs(proc.cfg, dir)
+	}
+}
+
+// Stop stops the sync process. Conversions that are already running are
+// finished, the work list items that haven't been started yet are dropped
 func (proc *Process) Stop() {
+	proc.stopOnc.Do(func() { close(proc.stop) })
 	proc.pl.Stop()
 	proc.stopped = true
 }
 
+// Cancel stops the sync process and aborts the conversions that are already
+// running. Their incomplete target files are removed
+func (proc *Process) Cancel() {
+	proc.Stop()
+	proc.cancel()
+}
+
+// Skipped returns the work list items that have not been processed since the
+// free space on the target device would have fallen below the reserve. It
+// must be called after the processing is finished
+func (proc *Process) Skipped() []*WorkItem {
+	return proc.skipped
+}
+
 // Wait waits for the sync process to be finished
 func (proc *Process) Wait() {
 	<-proc.done
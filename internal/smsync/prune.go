@@ -0,0 +1,95 @@
+package smsync
+
+// prune.go implements the reconciliation of the entire target directory tree
+// with the source directory tree: Target files that don't have a valid source
+// file (orphans) are determined and deleted.
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Orphans walks the entire target directory tree and maps every target file
+// back to its expected source file using the current rules and exclusions.
+// Target files without a valid source file are returned
+func Orphans(cfg *Config) (orphans []string) {
+	log.Debug("smsync.Orphans: BEGIN")
+	defer log.Debug("smsync.Orphans: END")
+
+	exp := expTrgFiles(cfg)
+
+	walkTrgFiles(cfg, func(path, rel string, inf fs.FileInfo) {
+		if _, ok := exp[rel]; ok {
+			return
+		}
+		// if the override file of the corresponding source directory is
+		// invalid, the source files could not be checked. Thus, the target
+		// file is kept to be on the safe side
+		if cfg.dirOvr(filepath.Join(cfg.SrcDir.Path(), filepath.Dir(rel))).err != nil {
+			return
+		}
+		orphans = append(orphans, path)
+	})
+
+	sort.Strings(orphans)
+	return orphans
+}
+
+// walkTrgFiles walks the entire target directory tree and calls fn for every
+// regular file with its absolute path, its path relative to the target
+// directory and its file info. smsync files (such as config file, manifest,
+// log file or the error directory) are skipped
+func walkTrgFiles(cfg *Config, fn func(path, rel string, inf fs.FileInfo)) {
+	err := filepath.WalkDir(cfg.TrgDir.Path(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Errorf("walkTrgFiles: %v", err)
+			return nil
+		}
+		rel := relPath(cfg.TrgDir.Path(), path)
+
+		// skip smsync files and the error directory
+		if (filepath.Dir(rel) == "." && (isSmsyncFile(d.Name()) || d.Name() == errDir)) || path == cfg.cfgPath {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// symbolic links are only relevant if they are created by smsync
+		if d.IsDir() || !(d.Type().IsRegular() || (d.Type()&fs.ModeSymlink != 0 && cfg.Symlinks == SymlinksCopy)) {
+			return nil
+		}
+		inf, err := d.Info()
+		if err != nil {
+			log.Errorf("walkTrgFiles: %v", err)
+			return nil
+		}
+		fn(path, rel, inf)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("walkTrgFiles: %v", err)
+	}
+}
+
+// Prune deletes the orphaned target files orphans and removes them from the
+// manifest. Target directories that are empty afterwards are deleted as well.
+// The number of files that could not be deleted is returned
+func Prune(cfg *Config, orphans []string) (errs int) {
+	log.Debug("smsync.Prune: BEGIN")
+	defer log.Debug("smsync.Prune: END")
+
+	for _, f := range orphans {
+		if err := deleteObsoleteFile(cfg, f); err != nil {
+			errs++
+			continue
+		}
+		deleteEmptyDirs(cfg, filepath.Dir(f))
+		cfg.mf.remove(relPath(cfg.TrgDir.Path(), f))
+	}
+	cfg.mf.write()
+
+	return errs
+}
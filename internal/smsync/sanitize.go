@@ -0,0 +1,120 @@
+package smsync
+
+// sanitize.go implements the sanitization of target file and directory names
+// for the file system of the target. FAT32 (vfat) and exFAT don't support
+// certain characters in names, names with trailing dots or spaces and names
+// that are longer than 255 characters. Names that violate these restrictions
+// are changed deterministically, so that the same source path always leads to
+// the same target path.
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// constants for the file system of the target
+const (
+	TrgFSPosix = "posix" // POSIX file system (e.g. ext4): no restrictions except the length of names
+	TrgFSVFAT  = "vfat"  // FAT32
+	TrgFSExFAT = "exfat" // exFAT
+)
+
+// maxNameLen is the maximum length of a file or directory name. For POSIX file
+// systems, it's measured in bytes. For vfat and exFAT, it's measured in UTF-16
+// code units
+const maxNameLen = 255
+
+// maxTrgNameLen is the maximum length of target names. The length of the
+// prefix of temporary files is reserved, since the temporary file of a target
+// file must not exceed maxNameLen either
+const maxTrgNameLen = maxNameLen - len(tmpPrefix)
+
+// fatInvalid contains the characters that are not allowed in names on vfat
+// and exFAT file systems (in addition to control characters)
+const fatInvalid = `"*/:<>?\|`
+
+// fatReserved contains the names that are reserved on vfat and exFAT file
+// systems (independent of the suffix)
+var fatReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// isFAT returns true if trgFS is vfat or exFAT
+func isFAT(trgFS string) bool {
+	return trgFS == TrgFSVFAT || trgFS == TrgFSExFAT
+}
+
+// sanitizePath sanitizes every element of the relative path rel for the
+// target file system trgFS
+func sanitizePath(trgFS string, rel string) string {
+	elems := strings.Split(rel, string(filepath.Separator))
+	for i := range elems {
+		elems[i] = sanitizeName(trgFS, elems[i])
+	}
+	return filepath.Join(elems...)
+}
+
+// sanitizeName sanitizes the file or directory name for the target file
+// system trgFS
+func sanitizeName(trgFS string, name string) string {
+	if isFAT(trgFS) {
+		// replace invalid characters
+		name = strings.Map(func(r rune) rune {
+			if r < 0x20 || strings.ContainsRune(fatInvalid, r) {
+				return '_'
+			}
+			return r
+		}, name)
+
+		// remove trailing dots and spaces
+		name = strings.TrimRight(name, ". ")
+		if name == "" {
+			name = "_"
+		}
+
+		// prefix reserved names
+		trunk := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if fatReserved[trunk] {
+			name = "_" + name
+		}
+	}
+
+	return truncName(trgFS, name)
+}
+
+// truncName shortens name to the maximum length of target names on the
+// target file system trgFS (see maxTrgNameLen). The suffix is kept
+func truncName(trgFS string, name string) string {
+	length := func(s string) int {
+		if isFAT(trgFS) {
+			return len(utf16.Encode([]rune(s)))
+		}
+		return len(s)
+	}
+
+	if length(name) <= maxTrgNameLen {
+		return name
+	}
+
+	suffix := filepath.Ext(name)
+	if length(suffix) >= maxTrgNameLen {
+		suffix = ""
+	}
+	trunk := []rune(strings.TrimSuffix(name, suffix))
+	for len(trunk) > 0 && length(string(trunk))+length(suffix) > maxTrgNameLen {
+		trunk = trunk[:len(trunk)-1]
+	}
+	return string(trunk) + suffix
+}
+
+// collKey returns the key of the relative target path rel that is used to
+// detect collisions. On vfat and exFAT, names are case-insensitive
+func collKey(trgFS string, rel string) string {
+	if isFAT(trgFS) {
+		return strings.ToLower(rel)
+	}
+	return rel
+}
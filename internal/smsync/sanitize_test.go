@@ -0,0 +1,66 @@
+package smsync
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		trgFS string
+		name  string
+		want  string
+	}{
+		{TrgFSPosix, `a:b?.mp3`, `a:b?.mp3`},
+		{TrgFSPosix, "trailing. ", "trailing. "},
+		{TrgFSVFAT, `a:b?.mp3`, `a_b_.mp3`},
+		{TrgFSVFAT, "a\tb<>|*.mp3", "a_b____.mp3"},
+		{TrgFSExFAT, `AC/DC "Live"`, `AC_DC _Live_`},
+		{TrgFSVFAT, "trailing. ", "trailing"},
+		{TrgFSVFAT, "...", "_"},
+		{TrgFSVFAT, "con", "_con"},
+		{TrgFSExFAT, "Nul.mp3", "_Nul.mp3"},
+		{TrgFSVFAT, "COM1.tar.gz", "_COM1.tar.gz"},
+		{TrgFSVFAT, "CONSOLE.mp3", "CONSOLE.mp3"},
+		{TrgFSPosix, "con", "con"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeName(tt.trgFS, tt.name); got != tt.want {
+			t.Errorf("sanitizeName(%s, %q) = %q, want %q", tt.trgFS, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTruncName(t *testing.T) {
+	tests := []struct {
+		trgFS  string
+		name   string
+		length func(string) int
+		want   int
+	}{
+		{TrgFSPosix, strings.Repeat("a", 300) + ".mp3", func(s string) int { return len(s) }, maxTrgNameLen},
+		// runes are not split: "ä" has two bytes
+		{TrgFSPosix, strings.Repeat("ä", 200) + ".mp3", func(s string) int { return len(s) }, maxTrgNameLen - 1},
+		{TrgFSVFAT, strings.Repeat("ä", 300) + ".mp3", func(s string) int { return len(utf16.Encode([]rune(s))) }, maxTrgNameLen},
+	}
+
+	for _, tt := range tests {
+		got := sanitizeName(tt.trgFS, tt.name)
+		if n := tt.length(got); n != tt.want {
+			t.Errorf("sanitizeName(%s, %.10q...): length is %d, want %d", tt.trgFS, tt.name, n, tt.want)
+		}
+		if !strings.HasSuffix(got, ".mp3") {
+			t.Errorf("sanitizeName(%s, %.10q...): suffix got lost", tt.trgFS, tt.name)
+		}
+		if !strings.HasPrefix(tt.name, strings.TrimSuffix(got, ".mp3")) {
+			t.Errorf("sanitizeName(%s, %.10q...): %q is not a prefix of the name", tt.trgFS, tt.name, got)
+		}
+	}
+
+	// short names are kept
+	if got := sanitizeName(TrgFSPosix, "short.mp3"); got != "short.mp3" {
+		t.Errorf("sanitizeName(%s, short.mp3) = %q", TrgFSPosix, got)
+	}
+}
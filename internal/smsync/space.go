@@ -0,0 +1,128 @@
+package smsync
+
+// space.go implements the guard for the free space on the target device.
+// If a reserve is configured, the conversions of an album are only started if
+// the free space is expected to stay above the reserve after them and after
+// the conversions that are already running or pending. The expected size of
+// target files is estimated with the compression rate of the conversions that
+// are already finished. Once the reserve would be undercut, no further
+// conversions are started.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ricochet2200/go-disk-usage/du"
+	log "github.com/sirupsen/logrus"
+)
+
+// sizeUnits maps the units of sizes to their factor
+var sizeUnits = map[string]uint64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+// parseSize parses a size such as '2GB' or '500 MB'. Units are
+// case-insensitive and refer to powers of 1024. A number without unit is
+// interpreted as number of bytes
+func parseSize(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	f, ok := sizeUnits[strings.TrimSpace(s[i:])]
+	if !ok {
+		return 0, fmt.Errorf("'%s' is not a valid size: unknown unit", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a valid size", s)
+	}
+	return uint64(n * float64(f)), nil
+}
+
+// spaceGuard keeps track of the free space on the target device during
+// processing
+type spaceGuard struct {
+	dir     string           // target directory
+	minFree uint64           // reserve that must stay free
+	comp    float64          // compression rate of the finished conversions (1 as long as there are none)
+	pending map[string]int64 // expected target sizes of running conversions (key: source file path)
+	low     bool             // reserve has been reached
+	mu      sync.Mutex
+}
+
+// newSpaceGuard creates a space guard for the target directory dir with the
+// reserve minFree. If minFree is zero, nil is returned
+func newSpaceGuard(dir string, minFree uint64) *spaceGuard {
+	if minFree == 0 {
+		return nil
+	}
+	return &spaceGuard{
+		dir:     dir,
+		minFree: minFree,
+		comp:    1,
+		pending: make(map[string]int64),
+	}
+}
+
+// reserve checks if the conversions items (typically the conversions of an
+// album) can be started without undercutting the reserve. If that's the case,
+// the expected target sizes are registered as pending and true is returned.
+// Otherwise, false is returned and no further conversion is allowed
+func (g *spaceGuard) reserve(items []*WorkItem) bool {
+	if g == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.low {
+		return false
+	}
+
+	var pending, exp int64
+	for _, n := range g.pending {
+		pending += n
+	}
+	for _, item := range items {
+		exp += int64(g.comp * float64(item.SrcFile.Size()))
+	}
+	if free := int64(du.NewDiskUsage(g.dir).Available()); free-pending-exp < int64(g.minFree) {
+		log.Warningf("Free space on target device is about to fall below %d MB: no further conversions are started", g.minFree>>20)
+		g.low = true
+		return false
+	}
+	for _, item := range items {
+		g.pending[item.SrcFile.Path()] = int64(g.comp * float64(item.SrcFile.Size()))
+	}
+	return true
+}
+
+// release removes the conversion of the source file srcPath from the pending
+// conversions and updates the compression rate with comp
+func (g *spaceGuard) release(srcPath string, comp float64) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.pending, srcPath)
+	if comp > 0 {
+		g.comp = comp
+	}
+}
@@ -0,0 +1,37 @@
+package smsync
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want uint64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{"100b", 100, true},
+		{"2k", 2 << 10, true},
+		{"500 MB", 500 << 20, true},
+		{"2GB", 2 << 30, true},
+		{"1.5g", 3 << 29, true},
+		{" 1 Tb ", 1 << 40, true},
+		{"", 0, false},
+		{"GB", 0, false},
+		{"2 PB", 0, false},
+		{"2x", 0, false},
+		{"1.2.3 MB", 0, false},
+		{"-1 GB", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSize(%q): error = %v, want ok = %v", tt.s, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
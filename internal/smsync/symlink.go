@@ -0,0 +1,323 @@
+package smsync
+
+// symlink.go implements the traversal of the source directory tree and the
+// handling of symbolic links in it. Per default, symbolic links are skipped.
+// In mode follow, linked directories and files are treated like regular
+// ones. Loops (i.e. links to a directory that is already being traversed) are
+// detected and skipped. In mode copy-link, the links are recreated in the
+// target directory. They point to the target counterpart of the source
+// directory or file they link to.
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+)
+
+// constants for the handling of symbolic links in the source tree
+const (
+	SymlinksSkip   = "skip"      // ignore symbolic links
+	SymlinksFollow = "follow"    // treat linked directories and files like regular ones
+	SymlinksCopy   = "copy-link" // recreate symbolic links in the target directory
+)
+
+// linkRule is the prefix of the rule that is stored in the manifest for
+// symbolic links (mode copy-link)
+const linkRule = "link"
+
+// pathInfo implements file.Info for file infos that have not been created
+// with file.Stat (e.g. for symbolic links themselves)
+type pathInfo struct {
+	fs.FileInfo
+	path string
+}
+
+// Path returns the complete path of the file
+func (p pathInfo) Path() string { return p.path }
+
+// findSrc traverses the source directory tree. It works like file.Find: The
+// function filter determines whether a file is relevant and whether
+// sub directories are traversed. The relevant files are returned. Symbolic
+// links are handled according to the configuration. In mode copy-link, the
+// symbolic links that are in scope are returned as well
+func (cfg *Config) findSrc(filter func(file.Info, file.ValidPropagate) (bool, file.ValidPropagate)) (files []file.Info, links []file.Info) {
+	var (
+		descend func(file.Info, []string, file.ValidPropagate) // func needs to be declared here since it calls itself recursively
+		wg      sync.WaitGroup                                 // waiting group for the concurrent traversal
+		mu      sync.Mutex                                     // protects files and links
+		sema    = make(chan struct{}, 1)                       // restricts the number of concurrent directory reads
+	)
+
+	// local function to filter a file and add it to the result if relevant
+	addFile := func(f file.Info, vp file.ValidPropagate) {
+		if ok, _ := filter(f, vp); ok {
+			mu.Lock()
+			files = append(files, f)
+			mu.Unlock()
+		}
+	}
+
+	// local function to read the entries of a directory
+	entries := func(dir string) []fs.DirEntry {
+		sema <- struct{}{}
+		defer func() { <-sema }()
+
+		entrs, err := os.ReadDir(dir)
+		if err != nil {
+			log.Errorf("findSrc: %v", err)
+			return nil
+		}
+		return entrs
+	}
+
+	// descend filters the directory dir and descends into it if required.
+	// chain contains the real paths of dir and its parent directories. It's
+	// used to detect loops
+	descend = func(dir file.Info, chain []string, vp file.ValidPropagate) {
+		defer wg.Done()
+
+		ok, vpSub := filter(dir, vp)
+		if ok {
+			mu.Lock()
+			files = append(files, dir)
+			mu.Unlock()
+		}
+		if vpSub == file.InvalidFromSuper {
+			return
+		}
+
+		for _, entr := range entries(dir.Path()) {
+			path := filepath.Join(dir.Path(), entr.Name())
+
+			// symbolic links
+			if entr.Type()&fs.ModeSymlink != 0 {
+				switch cfg.Symlinks {
+				case SymlinksFollow:
+					f, real, err := followLink(path, chain)
+					if err != nil {
+						log.Warningf("Symbolic link '%s' is skipped: %v", path, err)
+						continue
+					}
+					if f.IsDir() {
+						wg.Add(1)
+						go descend(f, append(append([]string{}, chain...), real), vpSub)
+					} else if f.Mode().IsRegular() {
+						addFile(f, vpSub)
+					}
+				case SymlinksCopy:
+					if l, ok := linkInScope(cfg, path); ok {
+						mu.Lock()
+						links = append(links, l)
+						mu.Unlock()
+					}
+				default:
+					log.Infof("Symbolic link '%s' is skipped", path)
+				}
+				continue
+			}
+
+			f, err := file.Stat(path)
+			if err != nil {
+				log.Errorf("findSrc: %v", err)
+				continue
+			}
+			if f.IsDir() {
+				wg.Add(1)
+				go descend(f, append(append([]string{}, chain...), filepath.Join(chain[len(chain)-1], entr.Name())), vpSub)
+				continue
+			}
+			// only regular files are relevant
+			if f.Mode().IsRegular() {
+				addFile(f, vpSub)
+			}
+		}
+	}
+
+	root, err := filepath.EvalSymlinks(cfg.SrcDir.Path())
+	if err != nil {
+		log.Errorf("findSrc: %v", err)
+		root = cfg.SrcDir.Path()
+	}
+	wg.Add(1)
+	go descend(cfg.SrcDir, []string{root}, file.NoneFromSuper)
+	wg.Wait()
+
+	return files, links
+}
+
+// followLink resolves the symbolic link path. For linked directories, the
+// real path is returned as well. If the linked directory is contained in
+// chain (i.e. it's already being traversed), an error is returned
+func followLink(path string, chain []string) (file.Info, string, error) {
+	f, err := file.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if !f.IsDir() {
+		return f, "", nil
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, dir := range chain {
+		if dir == real {
+			return nil, "", fmt.Errorf("loop detected: '%s' is a parent directory", real)
+		}
+	}
+	return f, real, nil
+}
+
+// linkInScope determines whether the symbolic link path is in scope (mode
+// copy-link). This is the case if the linked directory or file would be in
+// scope at the location of the link, and if it's located in the source
+// directory
+func linkInScope(cfg *Config, path string) (file.Info, bool) {
+	f, err := file.Stat(path)
+	if err != nil {
+		log.Warningf("Symbolic link '%s' is skipped: %v", path, err)
+		return nil, false
+	}
+	if ok, _ := inScope(cfg, f); !ok {
+		return nil, false
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		log.Errorf("linkInScope: %v", err)
+		return nil, false
+	}
+	return pathInfo{info, path}, true
+}
+
+// linkTrg determines for the symbolic link l in the source tree the path of
+// the corresponding link in the target tree and what it must point to. The
+// link target is relative and points to the target counterpart of the linked
+// source directory or file. If that's not possible since the link points
+// outside of the source directory or to a file that is out of scope, an
+// error is returned
+func linkTrg(cfg *Config, l file.Info) (trgFile string, linkTo string, err error) {
+	real, err := filepath.EvalSymlinks(l.Path())
+	if err != nil {
+		return "", "", err
+	}
+	srcDir, err := filepath.EvalSymlinks(cfg.SrcDir.Path())
+	if err != nil {
+		return "", "", err
+	}
+	realRel, err := filepath.Rel(srcDir, real)
+	if err != nil || realRel == ".." || strings.HasPrefix(realRel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("'%s' is not located in the source directory", real)
+	}
+	real = filepath.Join(cfg.SrcDir.Path(), realRel)
+
+	f, err := file.Stat(real)
+	if err != nil {
+		return "", "", err
+	}
+
+	var to string
+	if f.IsDir() {
+		trgFile = filepath.Join(cfg.TrgDir.Path(), sanitizePath(cfg.TrgFS, relPath(cfg.SrcDir.Path(), l.Path())))
+		to = filepath.Join(cfg.TrgDir.Path(), sanitizePath(cfg.TrgFS, realRel))
+	} else {
+		if ok, _ := inScope(cfg, f); !ok {
+			return "", "", fmt.Errorf("'%s' is out of scope", real)
+		}
+		trgFile = assembleTrgFile(cfg, l.Path())
+		to = assembleTrgFile(cfg, real)
+	}
+	if linkTo, err = filepath.Rel(filepath.Dir(trgFile), to); err != nil {
+		return "", "", err
+	}
+
+	return trgFile, linkTo, nil
+}
+
+// linkItem creates a work list item for the symbolic link l in the source
+// tree (mode copy-link). If the corresponding link in the target tree is up
+// to date, nil is returned. If the link cannot be recreated in the target
+// tree, nil and false is returned
+func linkItem(cfg *Config, l file.Info, init bool) (*WorkItem, bool) {
+	trgFile, linkTo, err := linkTrg(cfg, l)
+	if err != nil {
+		log.Warningf("Symbolic link '%s' is skipped: %v", l.Path(), err)
+		return nil, false
+	}
+	trgRel := relPath(cfg.TrgDir.Path(), trgFile)
+	srcRel := relPath(cfg.SrcDir.Path(), l.Path())
+
+	// mark target and source file as found. This is needed to identify
+	// obsolete target files later on
+	cfg.mf.see(trgRel, srcRel)
+
+	if e, ok := cfg.mf.get(trgRel); ok && !init && e.SrcFile == srcRel && e.Rule == linkRule+"|"+linkTo {
+		return nil, true
+	}
+	return &WorkItem{
+		Kind:    ItemLink,
+		SrcFile: l,
+		TrgFile: trgFile,
+		LinkTo:  linkTo,
+	}, true
+}
+
+// newLinkMfEntry creates the manifest entry for a symbolic link in the target
+// tree that has been created for the symbolic link l (with path srcRel
+// relative to the source directory) and points to linkTo
+func newLinkMfEntry(srcRel string, l file.Info, linkTo string) *mfEntry {
+	return &mfEntry{
+		SrcFile:    srcRel,
+		SrcModTime: mfModTime(l.ModTime()),
+		Rule:       linkRule + "|" + linkTo,
+	}
+}
+
+// createLink creates the symbolic link trgFile in the target tree that points
+// to linkTo. An existing file, link or directory (e.g. from a previous run in
+// mode follow) is replaced
+func createLink(cfg *Config, trgFile, linkTo string) error {
+	log.Debugf("smsync.createLink(%s): BEGIN", trgFile)
+	defer log.Debugf("smsync.createLink(%s): END", trgFile)
+
+	if err := cfg.mkTrgDir(filepath.Dir(trgFile)); err != nil {
+		log.Errorf("createLink: %v", err)
+		return err
+	}
+	if err := os.RemoveAll(trgFile); err != nil {
+		log.Errorf("createLink: %v", err)
+		return err
+	}
+	if err := os.Symlink(linkTo, trgFile); err != nil {
+		log.Errorf("createLink: %v", err)
+		return err
+	}
+	return nil
+}
+
+// linkedPath determines whether the path srcRel (relative to the source
+// directory) is a symbolic link itself or contains a symbolic link in one of
+// its parent directories
+func linkedPath(cfg *Config, srcRel string) (self bool, parent bool) {
+	path := cfg.SrcDir.Path()
+	elems := strings.Split(srcRel, string(filepath.Separator))
+	for i, elem := range elems {
+		path = filepath.Join(path, elem)
+		info, err := os.Lstat(path)
+		if err != nil {
+			return false, false
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if i == len(elems)-1 {
+				return true, false
+			}
+			return false, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,277 @@
+package smsync
+
+// template.go implements target path templates. A template defines the path
+// of a target file (relative to the target directory and without suffix)
+// based on the tags of the source file, instead of mirroring the folder
+// structure of the source directory. Templates consist of literal text and
+// fields in curly braces, e.g. '{albumartist}/{year} - {album}/{track:02}
+// {title}'. A field can have a width, in which case the value is padded with
+// leading zeros.
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+	fp "gitlab.com/go-utilities/filepath"
+)
+
+// tmplUnknown is the value of fields whose tag is not set
+const tmplUnknown = "Unknown"
+
+// tmplFields contains the supported template fields
+var tmplFields = map[string]bool{
+	"albumartist": true,
+	"artist":      true,
+	"album":       true,
+	"title":       true,
+	"track":       true,
+	"disc":        true,
+	"year":        true,
+	"genre":       true,
+	"composer":    true,
+}
+
+// tagKeys maps tag keys (as delivered by ffprobe, in lower case) to template
+// fields
+var tagKeys = map[string]string{
+	"album_artist": "albumartist",
+	"albumartist":  "albumartist",
+	"album artist": "albumartist",
+	"artist":       "artist",
+	"album":        "album",
+	"title":        "title",
+	"track":        "track",
+	"tracknumber":  "track",
+	"disc":         "disc",
+	"discnumber":   "disc",
+	"date":         "year",
+	"year":         "year",
+	"genre":        "genre",
+	"composer":     "composer",
+}
+
+// tmplPart is either a literal text or a field of a template
+type tmplPart struct {
+	lit   string // literal text (if field is empty)
+	field string // name of the field
+	width int    // minimum width of the field value (padded with zeros)
+}
+
+// pathTmpl is a parsed target path template
+type pathTmpl struct {
+	parts []tmplPart
+}
+
+// dirTags caches the tags that determine the target folder of files without
+// tags per source directory
+type dirTags struct {
+	dirs map[string]map[string]string
+	mu   sync.Mutex
+}
+
+// parseTmpl parses the target path template s
+func parseTmpl(s string) (*pathTmpl, error) {
+	if path.IsAbs(s) {
+		return nil, fmt.Errorf("'%s' is not a valid target path: it must be relative to the target directory", s)
+	}
+	for _, elem := range strings.Split(s, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return nil, fmt.Errorf("'%s' is not a valid target path: empty path elements, '.' and '..' are not allowed", s)
+		}
+	}
+
+	var t pathTmpl
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "{}")
+		if i < 0 {
+			t.parts = append(t.parts, tmplPart{lit: s})
+			break
+		}
+		if s[i] == '}' {
+			return nil, fmt.Errorf("'}' without '{' in target path")
+		}
+		if i > 0 {
+			t.parts = append(t.parts, tmplPart{lit: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("'{' without '}' in target path")
+		}
+		p, err := parseField(s[i+1 : i+j])
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, p)
+		s = s[i+j+1:]
+	}
+
+	return &t, nil
+}
+
+// parseField parses a template field of the form name or name:width
+func parseField(s string) (tmplPart, error) {
+	var p tmplPart
+
+	name, width, hasWidth := strings.Cut(s, ":")
+	p.field = strings.ToLower(strings.TrimSpace(name))
+	if !tmplFields[p.field] {
+		return p, fmt.Errorf("'%s' is not a supported field of target paths", name)
+	}
+	if hasWidth {
+		w, err := strconv.Atoi(width)
+		if err != nil || w <= 0 {
+			return p, fmt.Errorf("'%s' is not a valid width of field '%s'", width, name)
+		}
+		p.width = w
+	}
+	return p, nil
+}
+
+// render creates the target path from the template and the tags of a source
+// file
+func (t *pathTmpl) render(tags map[string]string) string {
+	var b strings.Builder
+
+	for _, p := range t.parts {
+		if p.field == "" {
+			b.WriteString(p.lit)
+			continue
+		}
+		v := tags[p.field]
+		if v == "" && p.field == "albumartist" {
+			v = tags["artist"]
+		}
+		if v == "" {
+			v = tmplUnknown
+		}
+		// a tag value must not create additional path elements
+		v = strings.ReplaceAll(v, "/", "_")
+		if v == "." || v == ".." {
+			v = "_"
+		}
+		if len(v) < p.width {
+			v = strings.Repeat("0", p.width-len(v)) + v
+		}
+		b.WriteString(v)
+	}
+
+	return filepath.FromSlash(b.String())
+}
+
+// normTags converts the tags of a file as delivered by ffprobe into template
+// fields. Track and disc numbers are reduced to the number (e.g. '3' instead
+// of '3/12'), the year is taken from the date
+func normTags(raw map[string]string) map[string]string {
+	tags := make(map[string]string)
+
+	for k, v := range raw {
+		field, ok := tagKeys[strings.ToLower(k)]
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch field {
+		case "track", "disc":
+			v, _, _ = strings.Cut(v, "/")
+		case "year":
+			if len(v) > 4 {
+				v = v[:4]
+			}
+		}
+		if v != "" {
+			tags[field] = v
+		}
+	}
+
+	return tags
+}
+
+// tmplTrunk determines the target path (relative to the target directory and
+// without suffix) of the source file srcFile with conversion rule cv from the
+// target path template. Files with a rule for their suffix are placed based on
+// their own tags. Other files (e.g. cover images) and files without tags are
+// placed in the target folder of the first file of the same source folder that
+// has tags, keeping their name. If that's not possible either, false is
+// returned
+func (cfg *Config) tmplTrunk(srcFile string, cv *cvm) (string, bool) {
+	if cv.SrcSuffix != suffixStar {
+		if tags, ok := cfg.srcTags(srcFile); ok {
+			return cfg.trgTmpl.render(tags), true
+		}
+	}
+
+	tags, ok := cfg.dirTags(filepath.Dir(srcFile))
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(cfg.trgTmpl.render(tags)), filepath.Base(fp.PathTrunk(srcFile))), true
+}
+
+// srcTags returns the tags of the source file srcFile. They are taken from
+// the manifest or determined with ffprobe. If srcFile doesn't have tags,
+// false is returned
+func (cfg *Config) srcTags(srcFile string) (map[string]string, bool) {
+	info, err := file.Stat(srcFile)
+	if err != nil {
+		log.Errorf("srcTags: %v", err)
+		return nil, false
+	}
+	p, err := cfg.mf.probe(relPath(cfg.SrcDir.Path(), srcFile), info)
+	if err != nil {
+		log.Debugf("srcTags: Tags of '%s' cannot be determined: %v", srcFile, err)
+		return nil, false
+	}
+	return p.Tags, len(p.Tags) > 0
+}
+
+// dirTags returns the tags of the first file (in lexical order) of the source
+// directory dir that has a rule for its suffix and has tags. The result is
+// cached
+func (cfg *Config) dirTags(dir string) (map[string]string, bool) {
+	cfg.tags.mu.Lock()
+	tags, ok := cfg.tags.dirs[dir]
+	cfg.tags.mu.Unlock()
+	if ok {
+		return tags, tags != nil
+	}
+
+	entrs, err := os.ReadDir(dir)
+	if err != nil {
+		log.Errorf("dirTags: %v", err)
+	}
+	for _, entr := range entrs {
+		if !entr.Type().IsRegular() {
+			continue
+		}
+		f := filepath.Join(dir, entr.Name())
+		info, err := file.Stat(f)
+		if err != nil {
+			continue
+		}
+		if ok, _ := inScope(cfg, info); !ok {
+			continue
+		}
+		if cv, _ := cfg.getCv(f); cv.SrcSuffix == suffixStar {
+			continue
+		}
+		if tags, ok = cfg.srcTags(f); ok {
+			break
+		}
+	}
+	if !ok {
+		tags = nil
+	}
+
+	cfg.tags.mu.Lock()
+	cfg.tags.dirs[dir] = tags
+	cfg.tags.mu.Unlock()
+
+	return tags, ok
+}
@@ -0,0 +1,99 @@
+package smsync
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTmpl(t *testing.T) {
+	tags := map[string]string{
+		"artist": "Miles Davis",
+		"album":  "Kind of Blue",
+		"title":  "So What",
+		"track":  "1",
+		"year":   "1959",
+	}
+
+	tests := []struct {
+		tmpl string
+		want string // rendered path, empty if the template is invalid
+	}{
+		{"{albumartist}/{year} - {album}/{track:02} {title}", "Miles Davis/1959 - Kind of Blue/01 So What"},
+		{"{ALBUM}/{Track:3}", "Kind of Blue/001"},
+		{"{genre}/{title}", "Unknown/So What"},
+		{"music/{artist}", "music/Miles Davis"},
+		{"/{artist}", ""},
+		{"{artist}//{title}", ""},
+		{"../{artist}", ""},
+		{"{artist", ""},
+		{"artist}", ""},
+		{"{label}", ""},
+		{"{track:0}", ""},
+		{"{track:x}", ""},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := parseTmpl(tt.tmpl)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseTmpl(%s): no error", tt.tmpl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTmpl(%s): %v", tt.tmpl, err)
+			continue
+		}
+		if got := tmpl.render(tags); got != filepath.FromSlash(tt.want) {
+			t.Errorf("parseTmpl(%s).render() = %s, want %s", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tmpl, err := parseTmpl("{artist}/{album}/{title}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{map[string]string{"artist": "AC/DC", "album": "..", "title": "."}, "AC_DC/_/_"},
+		{map[string]string{"title": "x"}, "Unknown/Unknown/x"},
+	}
+
+	for _, tt := range tests {
+		if got := tmpl.render(tt.tags); got != filepath.FromSlash(tt.want) {
+			t.Errorf("render(%v) = %s, want %s", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestNormTags(t *testing.T) {
+	tests := []struct {
+		raw  map[string]string
+		want map[string]string
+	}{
+		{
+			map[string]string{"ALBUM_ARTIST": "A", "Title": " T ", "track": "3/12", "DISC": "1/2", "date": "1999-05-01"},
+			map[string]string{"albumartist": "A", "title": "T", "track": "3", "disc": "1", "year": "1999"},
+		},
+		{
+			map[string]string{"tracknumber": "07", "discnumber": "2", "year": "2001", "album artist": "B"},
+			map[string]string{"track": "07", "disc": "2", "year": "2001", "albumartist": "B"},
+		},
+		{
+			map[string]string{"encoder": "x", "comment": "y", "genre": " ", "composer": "C"},
+			map[string]string{"composer": "C"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := normTags(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normTags(%v) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
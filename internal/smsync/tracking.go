@@ -2,16 +2,14 @@ package smsync
 
 import (
 	"time"
-
-	"gitlab.com/go-utilities/file"
 )
 
 // Tracking contains attributes that are used to keep track of the progress of
 // the processing
 type Tracking struct {
 	// number of files
-	TotalNum int // total number of files
-	Done     int // number of files / dirs that have been processed
+	TotalNum int // total number of work list items
+	Done     int // number of work list items that have been processed
 
 	// time
 	Started   time.Time     // start time of processing
@@ -38,15 +36,17 @@ type Tracking struct {
 }
 
 // newTrck create a Tracking instance
-func newTrck(wl *[]*file.Info, space uint64) *Tracking {
+func newTrck(wl *[]*WorkItem, space uint64) *Tracking {
 	trck := new(Tracking)
 
 	trck.TotalNum = len(*wl)
 	trck.Diskspace = space
 	trck.Out = make(chan ProcInfo)
 
-	for _, inf := range *wl {
-		trck.TotalSize += uint64((*inf).Size())
+	for _, item := range *wl {
+		if item.Kind == ItemConvert {
+			trck.TotalSize += uint64(item.SrcFile.Size())
+		}
 	}
 
 	return trck
@@ -77,7 +77,7 @@ func (trck *Tracking) update(pInfo ProcInfo) {
 		trck.Throughput = float64(trck.Done) / trck.Elapsed.Minutes()
 	}
 	trck.Done++
-	if pInfo.SrcFile != nil {
+	if pInfo.Kind == ItemConvert && pInfo.SrcFile != nil {
 		trck.SrcSize += uint64(pInfo.SrcFile.Size())
 	}
 	if pInfo.TrgFile != nil {
@@ -0,0 +1,108 @@
+package smsync
+
+// verify.go implements the comparison of the source directory tree with the
+// target directory tree. Nothing is changed, discrepancies are only reported.
+
+import (
+	"io/fs"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/go-utilities/file"
+	fp "gitlab.com/go-utilities/filepath"
+)
+
+// DiscKind is the kind of a discrepancy between source and target
+type DiscKind int
+
+// kinds of discrepancies
+const (
+	DiscMissing  DiscKind = iota // source file is in scope but the target file doesn't exist
+	DiscOutdated                 // source file has been changed since the target file has been created
+	DiscEmpty                    // target file has size zero
+	DiscSuffix                   // target file has the wrong suffix for the current rule
+	DiscNoSource                 // target file has no source file
+)
+
+// Discrepancy describes a difference between the source and the target
+// directory tree
+type Discrepancy struct {
+	Kind    DiscKind // kind of discrepancy
+	TrgFile string   // target file (relative to target directory)
+	SrcFile string   // source file (relative to source directory), empty if there's none
+}
+
+// outdated determines whether the target file trgRel (with file info inf) is
+// outdated, i.e. whether its source file srcFile has been changed since the
+// target file has been created. That's determined with the size and the
+// modification time of the source file that are recorded in the manifest.
+// Without manifest entry, the modification times of source and target file
+// are compared. That's only possible if the target file got the time of its
+// creation as modification time
+func outdated(cfg *Config, trgRel string, srcFile file.Info, inf fs.FileInfo) bool {
+	if e, ok := cfg.mf.get(trgRel); ok {
+		return e.SrcSize != srcFile.Size() || e.SrcModTime != mfModTime(srcFile.ModTime())
+	}
+	if cfg.TrgMTime != TrgMTimeNow {
+		return false
+	}
+	return inf.ModTime().Before(srcFile.ModTime())
+}
+
+// Verify compares the source directory tree with the target directory tree.
+// It builds the expected target tree from the current rules and exclusions
+// and reports source files whose target file doesn't exist, target files that
+// are outdated, target files with size zero or with the
+// wrong suffix for the current rule and target files without source file.
+// The discrepancies are returned sorted by target file path
+func Verify(cfg *Config) (discs []Discrepancy) {
+	log.Debug("smsync.Verify: BEGIN")
+	defer log.Debug("smsync.Verify: END")
+
+	var (
+		exp    = expTrgFiles(cfg)        // expected target files
+		trunks = make(map[string]string) // expected target files per trunk
+		found  = make(map[string]bool)   // expected target files that exist
+	)
+
+	for trgRel := range exp {
+		trunks[fp.PathTrunk(trgRel)] = trgRel
+	}
+
+	walkTrgFiles(cfg, func(path, rel string, inf fs.FileInfo) {
+		srcFile, ok := exp[rel]
+		if !ok {
+			// target file without source file: check if a source file
+			// exists that is converted to a different suffix
+			if trgRel, ok := trunks[fp.PathTrunk(rel)]; ok {
+				discs = append(discs, Discrepancy{Kind: DiscSuffix,
+					TrgFile: rel,
+					SrcFile: relPath(cfg.SrcDir.Path(), exp[trgRel].Path())})
+				return
+			}
+			discs = append(discs, Discrepancy{Kind: DiscNoSource, TrgFile: rel})
+			return
+		}
+		found[rel] = true
+
+		srcRel := relPath(cfg.SrcDir.Path(), srcFile.Path())
+		if inf.Size() == 0 {
+			discs = append(discs, Discrepancy{Kind: DiscEmpty, TrgFile: rel, SrcFile: srcRel})
+			return
+		}
+		if outdated(cfg, rel, srcFile, inf) {
+			discs = append(discs, Discrepancy{Kind: DiscOutdated, TrgFile: rel, SrcFile: srcRel})
+		}
+	})
+
+	for trgRel, srcFile := range exp {
+		if !found[trgRel] {
+			discs = append(discs, Discrepancy{Kind: DiscMissing,
+				TrgFile: trgRel,
+				SrcFile: relPath(cfg.SrcDir.Path(), srcFile.Path())})
+		}
+	}
+
+	sort.Slice(discs, func(i, j int) bool { return discs[i].TrgFile < discs[j].TrgFile })
+	return discs
+}